@@ -58,6 +58,7 @@ func init() {
 	dummySAS := "SharedAccessSignature sr=<hubname>.azure-devices.net%2Fdevices%2F<device name>&sig=...%2F..."
 
 	// az iot hub generate-sas-token -d sebEdgeDevice -n seb-hub --du 28800
+	// or without az CLI, see go/sas: sas device -host seb-hub.azure-devices.net -device sebEdgeDevice -key <device key> -du 8h
 	// amd64 - CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -o gomqttpub main.go
 	opts.SetPassword(dummySAS)
 
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// WindowConfig configures the aggregation window of a field.
+//
+// Tumbling windows are back to back and aligned to multiples of Size,
+// sliding windows cover the last Size of readings and close every Every.
+type WindowConfig struct {
+	Type  string        `yaml:"window"`
+	Size  time.Duration `yaml:"size"`
+	Every time.Duration `yaml:"every,omitempty"`
+}
+
+func (w *WindowConfig) validate() error {
+	if w.Size <= 0 {
+		return errors.New("window needs a size")
+	}
+	switch w.Type {
+	case "tumbling":
+		return nil
+	case "sliding":
+		if w.Every <= 0 || w.Every > w.Size {
+			return errors.New("sliding window needs every between zero and size")
+		}
+		return nil
+	}
+	return errors.New("window must be tumbling or sliding")
+}
+
+type sample struct {
+	T time.Time `json:"t"`
+	V float64   `json:"v"`
+}
+
+// fieldWindow is the persisted state of one field's window.
+type fieldWindow struct {
+	// End is when the current window closes.
+	End time.Time `json:"end"`
+
+	// Samples in the window, sliding windows keep them until
+	// they slide out, tumbling windows until the window closes.
+	Samples []sample `json:"samples,omitempty"`
+}
+
+// Aggregator accumulates readings into per-field windows,
+// the state is saved to a file to survive restarts.
+type Aggregator struct {
+	mu      sync.Mutex
+	config  map[string]WindowConfig
+	windows map[string]*fieldWindow
+	file    string
+	dirty   bool // changed since the last save
+}
+
+// newAggregator returns an aggregator restored from the given state file,
+// on restore errors an empty aggregator is returned along with the error.
+func newAggregator(config map[string]WindowConfig, file string) (*Aggregator, error) {
+	a := &Aggregator{
+		config:  config,
+		windows: make(map[string]*fieldWindow, len(config)),
+		file:    file,
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return a, nil
+		}
+		return a, err
+	}
+	var windows map[string]*fieldWindow
+	if err := json.Unmarshal(b, &windows); err != nil {
+		return a, err
+	}
+	for f, w := range windows {
+		if _, ok := config[f]; ok {
+			a.windows[f] = w
+		}
+	}
+	return a, nil
+}
+
+// Add adds a reading taken at t to the field's window.
+func (a *Aggregator) Add(field string, t time.Time, v float64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	wc, ok := a.config[field]
+	if !ok {
+		return
+	}
+	w := a.windows[field]
+	if w == nil {
+		w = &fieldWindow{End: nextEnd(wc, t)}
+		a.windows[field] = w
+	}
+	w.Samples = append(w.Samples, sample{T: t, V: v})
+	a.dirty = true
+}
+
+// Flush closes the windows that ended by now and returns their stats
+// (window, start, end, min, max, mean, count and last) per field.
+// Windows that ended without readings are skipped.
+func (a *Aggregator) Flush(now time.Time) map[string]map[string]interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make(map[string]map[string]interface{})
+	for f, w := range a.windows {
+		if now.Before(w.End) {
+			continue
+		}
+		a.dirty = true
+		wc := a.config[f]
+		start := w.End.Add(-wc.Size)
+		var in []sample
+		for _, s := range w.Samples {
+			if !s.T.Before(start) && s.T.Before(w.End) {
+				in = append(in, s)
+			}
+		}
+		if len(in) != 0 {
+			out[f] = aggregate(wc.Type, start, w.End, in)
+		}
+
+		if wc.Type == "sliding" {
+			// keep the samples still inside the next window
+			next := nextEnd(wc, now)
+			keep := w.Samples[:0]
+			for _, s := range w.Samples {
+				if !s.T.Before(next.Add(-wc.Size)) {
+					keep = append(keep, s)
+				}
+			}
+			w.Samples, w.End = keep, next
+		} else {
+			w.Samples, w.End = nil, nextEnd(wc, now)
+		}
+	}
+	return out
+}
+
+// Save writes the aggregation state to its file, if it changed since the last save.
+func (a *Aggregator) Save() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.config) == 0 || !a.dirty {
+		return nil
+	}
+	b, err := json.Marshal(a.windows)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(a.file, b); err != nil {
+		return err
+	}
+	a.dirty = false
+	return nil
+}
+
+// nextEnd returns the end of the window that t falls into.
+func nextEnd(wc WindowConfig, t time.Time) time.Time {
+	step := wc.Size
+	if wc.Type == "sliding" {
+		step = wc.Every
+	}
+	return t.Truncate(step).Add(step)
+}
+
+func aggregate(window string, start, end time.Time, samples []sample) map[string]interface{} {
+	lo, hi, sum := math.Inf(1), math.Inf(-1), 0.0
+	for _, s := range samples {
+		lo = math.Min(lo, s.V)
+		hi = math.Max(hi, s.V)
+		sum += s.V
+	}
+	return map[string]interface{}{
+		"window": window,
+		"start":  start.UTC().Format(time.RFC3339),
+		"end":    end.UTC().Format(time.RFC3339),
+		"min":    lo,
+		"max":    hi,
+		"mean":   sum / float64(len(samples)),
+		"count":  len(samples),
+		"last":   samples[len(samples)-1].V,
+	}
+}
+
+// writeFileAtomic writes the file through a temporary file and a rename,
+// so a reboot in the middle of the write never leaves it truncated.
+func writeFileAtomic(name string, b []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2021, 4, 12, 8, 0, 0, 0, time.UTC)
+
+func at(d time.Duration) time.Time {
+	return t0.Add(d)
+}
+
+func TestWindowConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		wc WindowConfig
+		ok bool
+	}{
+		{WindowConfig{Type: "tumbling", Size: time.Minute}, true},
+		{WindowConfig{Type: "sliding", Size: 5 * time.Minute, Every: time.Minute}, true},
+		{WindowConfig{Type: "sliding", Size: time.Minute, Every: time.Minute}, true},
+		{WindowConfig{Type: "tumbling"}, false},
+		{WindowConfig{Type: "sliding", Size: time.Minute}, false},
+		{WindowConfig{Type: "sliding", Size: time.Minute, Every: 2 * time.Minute}, false},
+		{WindowConfig{Type: "hopping", Size: time.Minute}, false},
+	} {
+		if err := tt.wc.validate(); (err == nil) != tt.ok {
+			t.Errorf("validate(%+v) = %v, want ok %v", tt.wc, err, tt.ok)
+		}
+	}
+}
+
+func TestTumblingWindow(t *testing.T) {
+	a, err := newAggregator(map[string]WindowConfig{
+		"temperature": {Type: "tumbling", Size: time.Minute},
+	}, filepath.Join(t.TempDir(), "aggregate.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Add("temperature", at(10*time.Second), 20)
+	a.Add("temperature", at(30*time.Second), 24)
+	a.Add("temperature", at(50*time.Second), 22)
+	a.Add("humidity", at(50*time.Second), 60) // not aggregated
+
+	if out := a.Flush(at(59 * time.Second)); len(out) != 0 {
+		t.Fatalf("Flush before the window end = %v", out)
+	}
+	out := a.Flush(at(time.Minute))
+	st := out["temperature"]
+	if len(out) != 1 || st["min"] != 20.0 || st["max"] != 24.0 || st["mean"] != 22.0 ||
+		st["count"] != 3 || st["last"] != 22.0 || st["window"] != "tumbling" ||
+		st["start"] != "2021-04-12T08:00:00Z" || st["end"] != "2021-04-12T08:01:00Z" {
+		t.Fatalf("Flush = %v", out)
+	}
+
+	// an empty window is skipped, the next one starts where the reading falls
+	if out := a.Flush(at(2 * time.Minute)); len(out) != 0 {
+		t.Fatalf("Flush of an empty window = %v", out)
+	}
+	a.Add("temperature", at(2*time.Minute+5*time.Second), 30)
+	out = a.Flush(at(3*time.Minute + 10*time.Second)) // flushed late
+	if st := out["temperature"]; st["count"] != 1 || st["start"] != "2021-04-12T08:02:00Z" {
+		t.Fatalf("Flush = %v", out)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	a, err := newAggregator(map[string]WindowConfig{
+		"humidity": {Type: "sliding", Size: 3 * time.Minute, Every: time.Minute},
+	}, filepath.Join(t.TempDir(), "aggregate.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := []int{}
+	for m := 0; m < 5; m++ {
+		a.Add("humidity", at(time.Duration(m)*time.Minute+30*time.Second), float64(m))
+		out := a.Flush(at(time.Duration(m+1) * time.Minute))
+		counts = append(counts, out["humidity"]["count"].(int))
+		if last := out["humidity"]["last"]; last != float64(m) {
+			t.Fatalf("minute %d: last = %v", m, last)
+		}
+	}
+	// the window fills up to 3 minutes of readings, then slides
+	want := []int{1, 2, 3, 3, 3}
+	for i := range want {
+		if counts[i] != want[i] {
+			t.Fatalf("counts = %v, want %v", counts, want)
+		}
+	}
+	if n := len(a.windows["humidity"].Samples); n != 2 {
+		t.Fatalf("samples kept = %d, want the 2 still inside the next window", n)
+	}
+}
+
+func TestAggregatorSaveRestore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "aggregate.json")
+	config := map[string]WindowConfig{"temperature": {Type: "tumbling", Size: time.Minute}}
+	a, err := newAggregator(config, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("unchanged state saved: %v", err)
+	}
+	a.Add("temperature", at(10*time.Second), 20)
+	a.Add("temperature", at(20*time.Second), 30)
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart mid-window keeps the readings
+	b, err := newAggregator(config, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Add("temperature", at(30*time.Second), 40)
+	if out := b.Flush(at(time.Minute)); out["temperature"]["count"] != 3 || out["temperature"]["mean"] != 30.0 {
+		t.Fatalf("Flush after restore = %v", out)
+	}
+
+	// saved only once changed again
+	os.Remove(file)
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(file); err != nil {
+		t.Fatalf("state after the flush not saved: %v", err)
+	}
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatal("unchanged state saved again")
+	}
+
+	// fields no longer aggregated are dropped, a bad file gives an empty aggregator
+	c, err := newAggregator(map[string]WindowConfig{"humidity": {Type: "tumbling", Size: time.Minute}}, file)
+	if err != nil || len(c.windows) != 0 {
+		t.Fatalf("restore of another config = %v, %v", c.windows, err)
+	}
+	if err := writeFileAtomic(file, []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := newAggregator(config, file); err == nil || d == nil || len(d.windows) != 0 {
+		t.Fatalf("restore of a bad file = %v, %v, want an empty aggregator and an error", d, err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BatchConfig configures batching of a source's documents into one message,
+// a batch is sent once it holds Size documents or is Interval old.
+type BatchConfig struct {
+	Size     int           `yaml:"size,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+func (c *BatchConfig) validate() error {
+	if c.Size < 0 || c.Interval < 0 {
+		return errors.New("batch size and interval must not be negative")
+	}
+	return nil
+}
+
+// Batcher collects the encoded documents of a source and publishes them,
+// batched and compressed as configured. Documents are only batched together
+// when the rules gave them the same properties.
+type Batcher struct {
+	mu          sync.Mutex
+	config      BatchConfig
+	codec       Codec
+	compression string
+	sign        string
+	encrypt     string
+
+	frames  []byte
+	count   int
+	props   map[string]string
+	started time.Time
+}
+
+func newBatcher(s *SourceConfig) *Batcher {
+	return &Batcher{
+		config:      s.Batch,
+		codec:       s.codec,
+		compression: s.Compression,
+		sign:        s.Sign,
+		encrypt:     s.Encrypt,
+	}
+}
+
+// batching reports whether documents are sent in batches rather than one by one.
+func (b *Batcher) batching() bool {
+	return b.config.Size > 1 || b.config.Interval > 0
+}
+
+// Add adds an encoded document with its properties, publishing the batch when full.
+func (b *Batcher) Add(now time.Time, props map[string]string, doc []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.batching() {
+		b.send(b.codec.ContentType(), doc, props, 0)
+		return
+	}
+	if b.count != 0 && !reflect.DeepEqual(props, b.props) {
+		b.flush()
+	}
+	frames := appendFrame(b.frames, doc)
+	if b.count != 0 && !b.fits(frames) {
+		b.flush()
+		frames = appendFrame(nil, doc)
+	}
+	if b.count == 0 {
+		b.props, b.started = props, now
+	}
+	b.frames, b.count = frames, b.count+1
+	if b.count >= b.config.Size && b.config.Size > 0 {
+		b.flush()
+	}
+}
+
+// FlushDue publishes the batch if it's older than the batch interval.
+func (b *Batcher) FlushDue(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.count != 0 && b.config.Interval > 0 && now.Sub(b.started) >= b.config.Interval {
+		b.flush()
+	}
+}
+
+// fits reports whether the batch stays within the message size limit,
+// the payload is only compressed to find out when it's too big as it is.
+func (b *Batcher) fits(frames []byte) bool {
+	if len(frames) <= MaxMessageSize {
+		return true
+	}
+	if b.compression == "" {
+		return false
+	}
+	c, err := compress(b.compression, frames)
+	return err == nil && len(c) <= MaxMessageSize
+}
+
+func (b *Batcher) flush() {
+	if b.count == 0 {
+		return
+	}
+	b.send(b.codec.ContentType(), b.frames, b.props, b.count)
+	b.frames, b.count, b.props = nil, 0, nil
+}
+
+// Publish publishes a payload of the given content type right away, outside
+// of any batch, compressed, encrypted and signed like the source's documents.
+func (b *Batcher) Publish(contentType string, payload []byte, props map[string]string) {
+	b.send(contentType, payload, props, 0)
+}
+
+// send publishes the payload, count is the number of documents in a batch or zero.
+// The payload is compressed, then encrypted, and the result signed along with
+// all the properties, the sequence number included, as configured.
+func (b *Batcher) send(ct string, payload []byte, props map[string]string, count int) {
+	ce := ""
+	all := make(map[string]string, len(props)+9)
+	for k, v := range props {
+		all[k] = v
+	}
+	if count != 0 {
+		all[BatchProperty] = strconv.Itoa(count)
+	}
+
+	var err error
+	if b.compression != "" {
+		if payload, err = compress(b.compression, payload); err != nil {
+			log.Printf("compress error: %v\n", err)
+			return
+		}
+		ce = b.compression
+	} else if b.encrypt == "" && ct == ContentTypeJSON {
+		ce = "utf-8"
+	}
+	if b.encrypt != "" {
+		var encProps map[string]string
+		if payload, encProps, err = keyring.Encrypt(b.encrypt, DeviceID, payload); err != nil {
+			log.Printf("encrypt error: %v\n", err)
+			return
+		}
+		for k, v := range encProps {
+			all[k] = v
+		}
+	}
+	seqProps, err := sequence.Next()
+	if err != nil {
+		log.Printf("Sequence error, publishing unstamped: %v\n", err)
+	}
+	for k, v := range seqProps {
+		all[k] = v
+	}
+	if b.sign != "" {
+		sigProps, err := keyring.Sign(b.sign, DeviceID, ct, ce, all, payload)
+		if err != nil {
+			log.Printf("sign error: %v\n", err)
+			return
+		}
+		for k, v := range sigProps {
+			all[k] = v
+		}
+	}
+
+	if len(payload) > MaxMessageSize {
+		log.Printf("Message of %d bytes dropped, it's over the size limit\n", len(payload))
+		return
+	}
+	publish(mqttClient, eventsTopic(ct, ce, all), payload)
+}
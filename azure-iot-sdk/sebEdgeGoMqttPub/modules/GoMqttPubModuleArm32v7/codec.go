@@ -0,0 +1,386 @@
+package main
+
+// This file is shared with go/sub/amqp/codec.go, keep both copies in sync.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/linkedin/goavro/v2"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Payload content types, protobuf and avro ones carry the schema name as a parameter.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeCBOR     = "application/cbor"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeAvro     = "application/avro"
+)
+
+// Content encodings ($.ce) of compressed payloads.
+const (
+	ContentEncodingGzip = "gzip"
+	ContentEncodingZstd = "zstd"
+)
+
+// MaxMessageSize is the IoT Hub device-to-cloud message size limit,
+// less some room for the topic property bag.
+const MaxMessageSize = 256*1024 - 8*1024
+
+// maxDecompressedSize bounds decompressed payloads, so a small
+// compressed message can't make the receiver run out of memory.
+const maxDecompressedSize = 16 * MaxMessageSize
+
+// errTooLarge is returned for payloads decompressing to more than maxDecompressedSize.
+var errTooLarge = fmt.Errorf("codec: decompressed payload over %d bytes", maxDecompressedSize)
+
+// BatchProperty is the application property carrying the number of
+// documents in a batched payload, each one framed by its uvarint length.
+// It's namespaced so a device's own properties aren't taken for batches.
+const BatchProperty = "gomqttpub-batch"
+
+// Codec converts documents to and from message payloads.
+type Codec interface {
+	// ContentType is the full content type set on messages, including parameters.
+	ContentType() string
+	Encode(doc map[string]interface{}) ([]byte, error)
+	Decode(b []byte) (map[string]interface{}, error)
+}
+
+// SchemaRegistry holds the protobuf message types and avro schemas
+// loaded from a local directory:
+//
+//	*.avsc       avro schemas, named by their full name
+//	*.pb, *.desc protobuf descriptor sets from
+//	             protoc --include_imports --descriptor_set_out
+type SchemaRegistry struct {
+	messages map[string]protoreflect.MessageDescriptor
+	avro     map[string]*goavro.Codec
+}
+
+// loadSchemaRegistry loads all schemas in dir, an empty dir gives an empty registry.
+func loadSchemaRegistry(dir string) (*SchemaRegistry, error) {
+	r := &SchemaRegistry{
+		messages: map[string]protoreflect.MessageDescriptor{},
+		avro:     map[string]*goavro.Codec{},
+	}
+	if dir == "" {
+		return r, nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		name := filepath.Join(dir, fi.Name())
+		switch filepath.Ext(name) {
+		case ".avsc":
+			err = r.loadAvro(name)
+		case ".pb", ".desc":
+			err = r.loadProto(name)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("schemas: %s: %v", name, err)
+		}
+	}
+	return r, nil
+}
+
+func (r *SchemaRegistry) loadAvro(name string) error {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	c, err := goavro.NewCodec(string(b))
+	if err != nil {
+		return err
+	}
+	// goavro doesn't expose the schema name, so it's read here
+	var s struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if s.Namespace != "" && !strings.Contains(s.Name, ".") {
+		s.Name = s.Namespace + "." + s.Name
+	}
+	r.avro[s.Name] = c
+	return nil
+}
+
+func (r *SchemaRegistry) loadProto(name string) error {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return err
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return err
+	}
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		addMessages(r.messages, fd.Messages())
+		return true
+	})
+	return nil
+}
+
+func addMessages(m map[string]protoreflect.MessageDescriptor, mds protoreflect.MessageDescriptors) {
+	for i := 0; i < mds.Len(); i++ {
+		md := mds.Get(i)
+		m[string(md.FullName())] = md
+		addMessages(m, md.Messages())
+	}
+}
+
+// Codec returns the codec for an encoding, json, cbor, protobuf or avro,
+// the latter two need the name of a schema in the registry.
+func (r *SchemaRegistry) Codec(encoding, schema string) (Codec, error) {
+	switch encoding {
+	case "", "json":
+		return jsonCodec{}, nil
+	case "cbor":
+		return cborCodec{}, nil
+	case "protobuf":
+		md, ok := r.messages[schema]
+		if !ok {
+			return nil, fmt.Errorf("codec: unknown protobuf message type %q", schema)
+		}
+		return protoCodec{md}, nil
+	case "avro":
+		c, ok := r.avro[schema]
+		if !ok {
+			return nil, fmt.Errorf("codec: unknown avro schema %q", schema)
+		}
+		return avroCodec{schema, c}, nil
+	}
+	return nil, fmt.Errorf("codec: unknown encoding %q", encoding)
+}
+
+// CodecFor returns the codec for a message content type,
+// messages without a content type are taken as JSON.
+func (r *SchemaRegistry) CodecFor(contentType string) (Codec, error) {
+	if contentType == "" {
+		return jsonCodec{}, nil
+	}
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	switch mt {
+	case ContentTypeJSON:
+		return r.Codec("json", "")
+	case ContentTypeCBOR:
+		return r.Codec("cbor", "")
+	case ContentTypeProtobuf:
+		return r.Codec("protobuf", params["messagetype"])
+	case ContentTypeAvro:
+		return r.Codec("avro", params["schema"])
+	}
+	return nil, fmt.Errorf("codec: unsupported content type %q", contentType)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Encode(doc map[string]interface{}) ([]byte, error) {
+	return json.Marshal(doc)
+}
+
+func (jsonCodec) Decode(b []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+type cborCodec struct{}
+
+// cborDecMode decodes maps with string keys like the other codecs.
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+func (cborCodec) ContentType() string {
+	return ContentTypeCBOR
+}
+
+func (cborCodec) Encode(doc map[string]interface{}) ([]byte, error) {
+	return cbor.Marshal(doc)
+}
+
+func (cborCodec) Decode(b []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if err := cborDecMode.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// protoCodec goes through the JSON mapping of the message type,
+// so documents use the proto field names or their JSON names.
+type protoCodec struct {
+	md protoreflect.MessageDescriptor
+}
+
+func (c protoCodec) ContentType() string {
+	return mime.FormatMediaType(ContentTypeProtobuf, map[string]string{
+		"messagetype": string(c.md.FullName()),
+	})
+}
+
+func (c protoCodec) Encode(doc map[string]interface{}) ([]byte, error) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	msg := dynamicpb.NewMessage(c.md)
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(msg)
+}
+
+func (c protoCodec) Decode(b []byte) (map[string]interface{}, error) {
+	msg := dynamicpb.NewMessage(c.md)
+	if err := proto.Unmarshal(b, msg); err != nil {
+		return nil, err
+	}
+	j, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return jsonCodec{}.Decode(j)
+}
+
+// avroCodec encodes documents as they are, fields not in the schema are left out,
+// and decodes through the avro JSON encoding.
+type avroCodec struct {
+	name  string
+	codec *goavro.Codec
+}
+
+func (c avroCodec) ContentType() string {
+	return mime.FormatMediaType(ContentTypeAvro, map[string]string{
+		"schema": c.name,
+	})
+}
+
+func (c avroCodec) Encode(doc map[string]interface{}) ([]byte, error) {
+	return c.codec.BinaryFromNative(nil, doc)
+}
+
+func (c avroCodec) Decode(b []byte) (map[string]interface{}, error) {
+	native, _, err := c.codec.NativeFromBinary(b)
+	if err != nil {
+		return nil, err
+	}
+	j, err := c.codec.TextualFromNative(nil, native)
+	if err != nil {
+		return nil, err
+	}
+	return jsonCodec{}.Decode(j)
+}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize))
+)
+
+// compress compresses the payload with the given content encoding.
+func compress(encoding string, b []byte) ([]byte, error) {
+	switch encoding {
+	case ContentEncodingGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case ContentEncodingZstd:
+		return zstdEncoder.EncodeAll(b, nil), nil
+	}
+	return nil, fmt.Errorf("codec: unknown compression %q", encoding)
+}
+
+// decompress decompresses the payload according to its content encoding,
+// up to maxDecompressedSize, payloads with any other content encoding,
+// like utf-8, are returned as they are.
+func decompress(encoding string, b []byte) ([]byte, error) {
+	switch encoding {
+	case ContentEncodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		d, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(d) > maxDecompressedSize {
+			return nil, errTooLarge
+		}
+		return d, nil
+	case ContentEncodingZstd:
+		d, err := zstdDecoder.DecodeAll(b, nil)
+		if err == zstd.ErrDecoderSizeExceeded {
+			return nil, errTooLarge
+		}
+		return d, err
+	}
+	return b, nil
+}
+
+// appendFrame appends the document payload b to the batch.
+func appendFrame(batch, b []byte) []byte {
+	var n [binary.MaxVarintLen64]byte
+	batch = append(batch, n[:binary.PutUvarint(n[:], uint64(len(b)))]...)
+	return append(batch, b...)
+}
+
+// splitFrames splits a batch into its document payloads.
+func splitFrames(batch []byte) ([][]byte, error) {
+	var frames [][]byte
+	for len(batch) > 0 {
+		n, k := binary.Uvarint(batch)
+		if k <= 0 || uint64(len(batch)-k) < n {
+			return nil, errors.New("codec: malformed batch")
+		}
+		frames = append(frames, batch[k:k+int(n)])
+		batch = batch[k+int(n):]
+	}
+	return frames, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// DeadbandConfig configures report-by-exception of a field,
+// a reading is only sent once it moves beyond the band around
+// the last sent value. With both set, either one being exceeded sends.
+type DeadbandConfig struct {
+	Absolute float64 `yaml:"absolute,omitempty"`
+	Percent  float64 `yaml:"percent,omitempty"`
+}
+
+func (d *DeadbandConfig) validate() error {
+	if d.Absolute < 0 || d.Percent < 0 {
+		return errors.New("deadband must not be negative")
+	}
+	return nil
+}
+
+// exceeded reports whether v is outside the band around last.
+func (d *DeadbandConfig) exceeded(last, v float64) bool {
+	delta := math.Abs(v - last)
+	if d.Absolute > 0 && delta > d.Absolute {
+		return true
+	}
+	if d.Percent > 0 && delta > math.Abs(last)*d.Percent/100 {
+		return true
+	}
+	return d.Absolute == 0 && d.Percent == 0 && delta != 0
+}
+
+// Deadband filters raw readings of a source, it keeps the last sent value
+// of each field and when it was sent for the heartbeat.
+type Deadband struct {
+	source    string
+	config    map[string]DeadbandConfig
+	heartbeat time.Duration
+	last      map[string]float64
+	lastSent  map[string]time.Time
+}
+
+func init() {
+	metrics.Help("gomqttpub_readings_total", "Raw readings taken per source and field.")
+	metrics.Help("gomqttpub_readings_suppressed_total", "Raw readings not sent because they stayed within the deadband.")
+	metrics.Help("gomqttpub_heartbeats_total", "Raw readings sent within the deadband because the heartbeat interval elapsed.")
+}
+
+func newDeadband(source string, config map[string]DeadbandConfig, heartbeat time.Duration) *Deadband {
+	return &Deadband{
+		source:    source,
+		config:    config,
+		heartbeat: heartbeat,
+		last:      make(map[string]float64, len(config)),
+		lastSent:  make(map[string]time.Time, len(config)),
+	}
+}
+
+// Filter removes the readings within their deadband from the given raw readings
+// and reports whether anything is left to send. A reading within the band is
+// still sent once the heartbeat interval elapsed since its field was last sent,
+// so the cloud sees the device alive.
+func (d *Deadband) Filter(now time.Time, readings map[string]float64) bool {
+	for f, v := range readings {
+		metrics.Inc("gomqttpub_readings_total", "source", d.source, "field", f)
+		db, ok := d.config[f]
+		if !ok {
+			continue
+		}
+		last, seen := d.last[f]
+		switch {
+		case !seen || db.exceeded(last, v):
+		case d.heartbeat > 0 && now.Sub(d.lastSent[f]) >= d.heartbeat:
+			metrics.Inc("gomqttpub_heartbeats_total", "source", d.source, "field", f)
+		default:
+			metrics.Inc("gomqttpub_readings_suppressed_total", "source", d.source, "field", f)
+			delete(readings, f)
+			continue
+		}
+		d.last[f], d.lastSent[f] = v, now
+	}
+	return len(readings) != 0
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadbandExceeded(t *testing.T) {
+	tests := []struct {
+		db      DeadbandConfig
+		last, v float64
+		want    bool
+	}{
+		{DeadbandConfig{Absolute: 0.5}, 20, 20.5, false},
+		{DeadbandConfig{Absolute: 0.5}, 20, 20.6, true},
+		{DeadbandConfig{Absolute: 0.5}, 20, 19.4, true},
+		{DeadbandConfig{Percent: 10}, 50, 55, false},
+		{DeadbandConfig{Percent: 10}, 50, 55.1, true},
+		{DeadbandConfig{Percent: 10}, -50, -44.9, true},
+		{DeadbandConfig{Percent: 10}, 0, 0.001, true}, // any change from zero
+		{DeadbandConfig{Absolute: 1, Percent: 1}, 200, 202.5, true},
+		{DeadbandConfig{Absolute: 1, Percent: 10}, 20, 20.9, false},
+		{DeadbandConfig{Absolute: 1, Percent: 1}, 20, 20.3, true}, // either one exceeded sends
+		{DeadbandConfig{Absolute: 1, Percent: 10}, 20, 21.5, true},
+		{DeadbandConfig{}, 20, 20, false},
+		{DeadbandConfig{}, 20, 20.01, true},
+	}
+	for _, tt := range tests {
+		if got := tt.db.exceeded(tt.last, tt.v); got != tt.want {
+			t.Errorf("%+v.exceeded(%v, %v) = %v, want %v", tt.db, tt.last, tt.v, got, tt.want)
+		}
+	}
+	if err := (&DeadbandConfig{Absolute: -1}).validate(); err == nil {
+		t.Error("negative absolute deadband: want an error")
+	}
+	if err := (&DeadbandConfig{Percent: -1}).validate(); err == nil {
+		t.Error("negative percent deadband: want an error")
+	}
+}
+
+func TestDeadbandFilter(t *testing.T) {
+	d := newDeadband("test", map[string]DeadbandConfig{
+		"temperature": {Absolute: 0.5},
+	}, 5*time.Minute)
+
+	steps := []struct {
+		at          time.Duration
+		temperature float64
+		sent        bool
+	}{
+		{0, 20, true}, // first reading
+		{time.Minute, 20.3, false},
+		{2 * time.Minute, 20.6, true}, // from 20, not 20.3
+		{3 * time.Minute, 20.2, false},
+		{7 * time.Minute, 20.2, true}, // heartbeat, 5 minutes since 20.6 was sent
+		{8 * time.Minute, 20.6, false},
+		{12 * time.Minute, 20.6, true},
+	}
+	for _, s := range steps {
+		readings := map[string]float64{"temperature": s.temperature}
+		if sent := d.Filter(t0.Add(s.at), readings); sent != s.sent {
+			t.Fatalf("at %v, %v: sent %v, want %v", s.at, s.temperature, sent, s.sent)
+		}
+		if _, kept := readings["temperature"]; kept != s.sent {
+			t.Fatalf("at %v: reading kept %v, want %v", s.at, kept, s.sent)
+		}
+	}
+
+	// fields without a deadband always go, taking the others along
+	readings := map[string]float64{"temperature": 20.6, "humidity": 60}
+	if !d.Filter(t0.Add(13*time.Minute), readings) || len(readings) != 1 || readings["humidity"] != 60 {
+		t.Fatalf("readings = %v, want only humidity", readings)
+	}
+}
+
+func TestDeadbandWithoutHeartbeat(t *testing.T) {
+	d := newDeadband("test", map[string]DeadbandConfig{"level": {Percent: 5}}, 0)
+	if !d.Filter(t0, map[string]float64{"level": 100}) {
+		t.Fatal("first reading not sent")
+	}
+	if d.Filter(t0.Add(24*time.Hour), map[string]float64{"level": 104}) {
+		t.Fatal("reading within the band sent without a heartbeat")
+	}
+	if !d.Filter(t0.Add(25*time.Hour), map[string]float64{"level": 94}) {
+		t.Fatal("reading 6% off not sent")
+	}
+}
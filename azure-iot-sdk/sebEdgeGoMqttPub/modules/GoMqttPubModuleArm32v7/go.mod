@@ -4,5 +4,10 @@ go 1.16
 
 require (
 	github.com/eclipse/paho.mqtt.golang v1.3.3
+	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/gorilla/mux v1.8.0
+	github.com/klauspost/compress v1.15.15
+	github.com/linkedin/goavro/v2 v2.12.0
+	google.golang.org/protobuf v1.28.1
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -1,11 +1,24 @@
 package main
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	mux "github.com/gorilla/mux"
@@ -13,6 +26,9 @@ import (
 
 var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
 	fmt.Println("Connected")
+	if err := subscribeTwin(client, desiredHandler); err != nil {
+		log.Printf("twin subscribe error: %v\n", err)
+	}
 }
 
 var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
@@ -28,40 +44,162 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(helloMsg))
 }
 
-// pingHandler is a http request handler for route /ping .
+// pingHandler is a http request handler for route /ping ,
+// the message is a JSON document signed and encrypted like the first source's.
 func pingHandler(w http.ResponseWriter, r *http.Request) {
+	if pingOut == nil {
+		http.Error(w, "no sources to publish with", http.StatusServiceUnavailable)
+		return
+	}
 	currentTime := time.Now()
 	mqttMsg := fmt.Sprintf("Hello from sebBeagle %s", currentTime.Format("2006.01.02 15:04:05"))
 
-	doPublish(mqttMsg)
+	doc := newDocument("ping", currentTime)
+	doc["message"] = mqttMsg
+	b, err := json.Marshal(doc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pingOut.Publish(ContentTypeJSON, b, nil)
 
 	pongMsg := "Published mqtt message from sebBeagle - " + mqttMsg + "\n"
+	log.Printf(pongMsg)
 	w.Write([]byte(pongMsg))
 }
 
-func doPublish(msg string) {
+// rulesHandler is a http request handler for route /rules ,
+// GET returns the current rule set, PUT or POST replaces it with the YAML body,
+// refused when it has actions not given with -allow-action.
+// Changes need the -rules-token bearer token, or without one, to come from localhost.
+func rulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/x-yaml")
+		w.Write(ruleEngine.Raw())
+		return
+	}
+	if !rulesAuthorized(r) {
+		http.Error(w, "rule changes need the rules token", http.StatusUnauthorized)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := ruleEngine.Load(b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	atomic.StoreInt32(&twinRules, 0)
+	w.Write([]byte("rules reloaded\n"))
+}
 
-	publish(mqttClient, MqttTopic, msg)
+// rulesAuthorized reports whether the request may change the rules.
+func rulesAuthorized(r *http.Request) bool {
+	if rulesToken != "" {
+		auth := r.Header.Get("Authorization")
+		return strings.HasPrefix(auth, "Bearer ") &&
+			subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(rulesToken)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
 
-	pongMsg := "Published mqtt message from sebBeagle - " + msg + "\n"
-	log.Printf(pongMsg)
+// desiredHandler reloads the rules whenever the twin desired properties carry them.
+// Twin rules are cleared when the property is emptied, or removed by setting it to null.
+func desiredHandler(desired map[string]interface{}) {
+	b, err := rulesFromDesired(desired)
+	if err == errNoRules {
+		if atomic.LoadInt32(&twinRules) == 0 {
+			return
+		}
+		b, err = noRules, nil
+	}
+	if err == nil {
+		err = ruleEngine.Load(b)
+	}
+	if err != nil {
+		log.Printf("twin rules error: %v\n", err)
+		return
+	}
+	atomic.StoreInt32(&twinRules, 1)
+}
+
+// doPublishLoop runs the sources until stop is closed, wg is done once they've all returned.
+func doPublishLoop(sources []SourceConfig, stateDir string, stop <-chan struct{}, wg *sync.WaitGroup) {
+	select {
+	case <-time.After(5 * time.Second): // delay start
+	case <-stop:
+		wg.Add(-len(sources))
+		return
+	}
+	for _, s := range sources {
+		go func(s SourceConfig) {
+			defer wg.Done()
+			runSource(s, stateDir, stop)
+		}(s)
+	}
 }
 
-func doPublishLoop() {
-	time.Sleep(5 * time.Second) // delay start
-	for {
-		currentTime := time.Now()
-		mqttMsg := fmt.Sprintf("Hello from sebBeagle %s", currentTime.Format("2006.01.02 15:04:05"))
+// publishTelemetry runs the rules against the document and publishes it
+// with the resulting properties, along with any alerts the rules raised.
+// Alerts are sent right away as JSON, the document is encoded and batched
+// as configured for its source, both signed and encrypted like the source's.
+func publishTelemetry(now time.Time, doc map[string]interface{}, out *Batcher) {
+	d := ruleEngine.Evaluate(doc)
+	for _, a := range d.Alerts {
+		b, err := json.Marshal(a)
+		if err != nil {
+			log.Printf("alert marshal error: %v\n", err)
+			continue
+		}
+		out.Publish(ContentTypeJSON, b, map[string]string{
+			"alert":    a.Rule,
+			"priority": "high",
+		})
+	}
+	if d.Suppress {
+		log.Printf("Telemetry suppressed by rules: %v\n", doc)
+		return
+	}
 
-		publish(mqttClient, MqttTopic, mqttMsg)
+	b, err := out.codec.Encode(doc)
+	if err != nil {
+		log.Printf("telemetry encode error: %v\n", err)
+		return
+	}
+	out.Add(now, d.Properties, b)
+}
 
-		time.Sleep(10 * time.Second)
+// eventsTopic appends the content type and encoding and the given application
+// properties to the events topic as its property bag.
+func eventsTopic(contentType, contentEncoding string, props map[string]string) string {
+	v := url.Values{}
+	v.Set("$.ct", contentType)
+	if contentEncoding != "" {
+		v.Set("$.ce", contentEncoding)
+	}
+	for k, pv := range props {
+		v.Set(k, pv)
 	}
+	return MqttTopic + v.Encode()
 }
 
 const DefaultMqttQoS = 1
-const MqttTopic = "devices/sebBeagle/messages/events/" // topic - devices/{device_id}/modules/{module_id}/messages/events/
+const DeviceID = "sebBeagle"
+const MqttTopic = "devices/" + DeviceID + "/messages/events/" // topic - devices/{device_id}/modules/{module_id}/messages/events/
 var mqttClient mqtt.Client
+var ruleEngine = &RuleEngine{}
+var keyring *Keyring
+var sequence *Sequence
+var pingOut *Batcher
+var rulesToken string
+var twinRules int32 // the rules in use came from the twin
 
 // initializes mqtt client connection to broker
 func init() {
@@ -70,12 +208,13 @@ func init() {
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(fmt.Sprintf("tls://%s:%d", broker, port))
 	opts.SetProtocolVersion(4)
-	opts.SetClientID("sebBeagle")
-	opts.SetUsername("<hubname>.azure-devices.net/sebBeagle/?api-version=2020-09-30")
+	opts.SetClientID(DeviceID)
+	opts.SetUsername("<hubname>.azure-devices.net/" + DeviceID + "/?api-version=2020-09-30")
 
 	// TODO: Need to manually generate SAS for now and paste into code. Actual build script can generate and store in ENV. Code can then read from ENV.
 	dummySAS := "SharedAccessSignature sr=<hubname>.azure-devices.net%2Fdevices%2F<device name>&sig=...%2F..."
 	// az iot hub generate-sas-token -d sebBeagle -n seb-hub --du 86400
+	// or without az CLI, see go/sas: sas device -host seb-hub.azure-devices.net -device sebBeagle -key <device key> -du 24h
 	// arm32 - GOOS=linux GOARCH=arm GOARM=5 go build -o gomqttpubarm32v7 main.go
 	// Monitor event hub from <path to codein>/go/eventhub
 	opts.SetPassword(dummySAS)
@@ -85,11 +224,75 @@ func init() {
 	mqttClient = mqtt.NewClient(opts)
 }
 
+// stringsFlag is a repeatable string flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
 func main() {
 	// Setting up a simple HTTP REST /ping request - where tester can ping to send mqtt msg
 	portPtr := flag.String("port", "8282", "port number")
+	rulesPtr := flag.String("rules", "", "rules YAML file")
+	var allowActions stringsFlag
+	flag.Var(&allowActions, "allow-action", "action rules loaded over HTTP or from the twin may run, repeatable")
+	flag.StringVar(&rulesToken, "rules-token", os.Getenv("RULES_TOKEN"), "bearer token to change rules over HTTP, $RULES_TOKEN by default, localhost only without one")
+	sourcesPtr := flag.String("sources", "", "sources YAML file, defaults to simulated readings every 10s")
+	statePtr := flag.String("state", ".", "directory to persist state across restarts")
+	schemasPtr := flag.String("schemas", "", "directory of protobuf descriptor sets and avro schemas")
+	keysPtr := flag.String("keys", "", "keyring JSON file of signing and encryption keys")
 	flag.Parse()
 
+	sources := defaultSources
+	if *sourcesPtr != "" {
+		var err error
+		if sources, err = loadSources(*sourcesPtr); err != nil {
+			log.Fatal("Loading sources: ", err)
+		}
+	}
+	schemas, err := loadSchemaRegistry(*schemasPtr)
+	if err != nil {
+		log.Fatal("Loading schemas: ", err)
+	}
+	if sequence, err = newSequence(filepath.Join(*statePtr, "sequence.json")); err != nil {
+		log.Fatal("Loading sequence: ", err)
+	}
+	if *keysPtr != "" {
+		if keyring, err = loadKeyring(*keysPtr); err != nil {
+			log.Fatal("Loading keys: ", err)
+		}
+	}
+	for i := range sources {
+		if sources[i].codec, err = schemas.Codec(sources[i].Encoding, sources[i].Schema); err != nil {
+			log.Fatalf("Source %s: %v", sources[i].Name, err)
+		}
+		if err = sources[i].checkKeys(keyring); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(sources) != 0 {
+		pingOut = newBatcher(&sources[0])
+	}
+
+	ruleEngine.AllowActions(allowActions)
+	if *rulesPtr != "" {
+		if err := ruleEngine.LoadFile(*rulesPtr); err != nil {
+			log.Fatal("Loading rules: ", err)
+		}
+	}
+
+	// stay connected to receive twin desired properties, paho reconnects on its own
+	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
+		panic(token.Error())
+	}
+
 	httpPort := *portPtr
 	httpURL := "0.0.0.0:" + httpPort
 	log.Printf("HTTP %s up and listening...\n", httpURL)
@@ -97,23 +300,38 @@ func main() {
 	r := mux.NewRouter()
 	// Routes consist of a path and a handler function.
 	r.HandleFunc("/ping", pingHandler)
+	r.Handle("/metrics", metrics)
+	r.HandleFunc("/rules", rulesHandler).Methods(http.MethodGet, http.MethodPut, http.MethodPost)
 	r.HandleFunc("/", defaultHandler)
 
-	go doPublishLoop() // A go-routine to send mqtt in a loop
+	// go-routines to send mqtt in a loop per source, saving their state on shutdown
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(len(sources))
+	go doPublishLoop(sources, *statePtr, stop, &wg)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		log.Printf("%v, shutting down\n", <-sig)
+		close(stop)
+		wg.Wait()
+		os.Exit(0)
+	}()
 
 	// Bind to a port and pass our router in
 	log.Fatal(http.ListenAndServe(httpURL, r))
 }
 
-func publish(client mqtt.Client, topic string, msg string) {
-
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
-	}
-	defer mqttClient.Disconnect(250)
+func publish(client mqtt.Client, topic string, msg []byte) {
 
 	log.Printf("Publishing to topic: %s\n", topic)
-	log.Printf("Sending message: %s\n", msg)
+	if utf8.Valid(msg) {
+		log.Printf("Sending message: %s\n", msg)
+	} else {
+		log.Printf("Sending message: %d bytes\n", len(msg))
+	}
 	token := client.Publish(topic, DefaultMqttQoS, false, msg)
-	token.Wait()
+	if token.Wait() && token.Error() != nil {
+		log.Printf("Publish error: %v\n", token.Error())
+	}
 }
@@ -0,0 +1,112 @@
+package main
+
+// This file is shared with go/sub/amqp/metrics.go, keep both copies in sync.
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics is a set of counters and gauges exported on /metrics in the Prometheus text format.
+type Metrics struct {
+	mu       sync.Mutex
+	help     map[string]string
+	gauges   map[string]bool               // names of the gauges, the rest are counters
+	counters map[string]map[string]float64 // name -> labels -> value
+}
+
+var metrics = &Metrics{
+	help:     map[string]string{},
+	gauges:   map[string]bool{},
+	counters: map[string]map[string]float64{},
+}
+
+// Help sets the help text of the named counter.
+func (m *Metrics) Help(name, help string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.help[name] = help
+}
+
+// Add adds v to the named counter, labels are given as name, value pairs.
+func (m *Metrics) Add(name string, v float64, labels ...string) {
+	l := labelString(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values(name)[l] += v
+}
+
+// Set sets the named gauge to v, labels are given as name, value pairs.
+func (m *Metrics) Set(name string, v float64, labels ...string) {
+	l := labelString(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = true
+	m.values(name)[l] = v
+}
+
+// values returns the values of the named metric by labels, m.mu held.
+func (m *Metrics) values(name string) map[string]float64 {
+	c, ok := m.counters[name]
+	if !ok {
+		c = map[string]float64{}
+		m.counters[name] = c
+	}
+	return c
+}
+
+func labelString(labels []string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", labels[i], labels[i+1])
+	}
+	return b.String()
+}
+
+// Inc increments the named counter by one.
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+// ServeHTTP writes all metrics sorted by name and labels.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.counters))
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		if help, ok := m.help[name]; ok {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		}
+		typ := "counter"
+		if m.gauges[name] {
+			typ = "gauge"
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+		c := m.counters[name]
+		labels := make([]string, 0, len(c))
+		for l := range c {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			if l == "" {
+				fmt.Fprintf(w, "%s %g\n", name, c[l])
+			} else {
+				fmt.Fprintf(w, "%s{%s} %g\n", name, l, c[l])
+			}
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Rule is a threshold rule evaluated on every outgoing telemetry document.
+//
+// A rule becomes active when its field goes above (or below) the threshold,
+// and stays active until the value crosses back over the clear level.
+// The gap between threshold and clear level is the hysteresis band that
+// stops the rule from flapping on readings hovering around the threshold.
+//
+// Example rules.yaml:
+//
+//	rules:
+//	  - name: temperatureAlert
+//	    field: temperature
+//	    above: 30
+//	    clear: 29
+//	    properties:
+//	      temperatureAlert: "true"
+//	    otherwise:
+//	      temperatureAlert: "false"
+//	    alert: temperature is above 30
+//	    action: logger -t gomqttpub "temperature alert"
+type Rule struct {
+	Name string `yaml:"name"`
+
+	// Field is the document field the rule looks at,
+	// nested fields are dot separated, e.g. temperature.max .
+	Field string   `yaml:"field"`
+	Above *float64 `yaml:"above,omitempty"`
+	Below *float64 `yaml:"below,omitempty"`
+
+	// Clear is the level at which an active rule goes inactive again,
+	// defaults to the threshold itself (no hysteresis).
+	Clear *float64 `yaml:"clear,omitempty"`
+
+	// Properties are added to the message while the rule is active.
+	Properties map[string]string `yaml:"properties,omitempty"`
+
+	// Otherwise are added to the message while the rule is inactive.
+	Otherwise map[string]string `yaml:"otherwise,omitempty"`
+
+	// Alert is sent as a separate priority message when the rule activates.
+	Alert string `yaml:"alert,omitempty"`
+
+	// Suppress drops the telemetry message while the rule is active.
+	Suppress bool `yaml:"suppress,omitempty"`
+
+	// Action is a shell command run locally when the rule activates.
+	// Rules loaded over HTTP or from the twin may only use allowed actions.
+	Action string `yaml:"action,omitempty"`
+}
+
+// RuleSet is the declarative YAML document holding all rules.
+type RuleSet struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Alert is a priority message raised by a rule on activation.
+type Alert struct {
+	Rule    string    `json:"rule"`
+	Field   string    `json:"field"`
+	Value   float64   `json:"value"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Decision is the outcome of evaluating the rules against one document.
+type Decision struct {
+	Properties map[string]string
+	Alerts     []Alert
+	Suppress   bool
+}
+
+// RuleEngine evaluates a rule set and keeps the active state of each rule.
+type RuleEngine struct {
+	mu     sync.Mutex
+	set    RuleSet
+	raw    []byte
+	active map[string]bool
+
+	// allowed are the actions rules loaded over HTTP or from the twin may run,
+	// the local rules file may run any.
+	allowed map[string]bool
+}
+
+// AllowActions allows remotely loaded rules to run the given actions.
+func (e *RuleEngine) AllowActions(actions []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.allowed = make(map[string]bool, len(actions))
+	for _, a := range actions {
+		e.allowed[a] = true
+	}
+}
+
+// parseRules parses and validates a YAML rule set.
+func parseRules(b []byte) (*RuleSet, error) {
+	var rs RuleSet
+	if err := yaml.UnmarshalStrict(b, &rs); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(rs.Rules))
+	for i, r := range rs.Rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("rules: rule %d has no name", i)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("rules: duplicate rule %q", r.Name)
+		}
+		names[r.Name] = true
+		if r.Field == "" {
+			return nil, fmt.Errorf("rules: rule %q has no field", r.Name)
+		}
+		if (r.Above == nil) == (r.Below == nil) {
+			return nil, fmt.Errorf("rules: rule %q needs exactly one of above or below", r.Name)
+		}
+		if r.Clear != nil {
+			if r.Above != nil && *r.Clear > *r.Above {
+				return nil, fmt.Errorf("rules: rule %q clear level must not be above threshold", r.Name)
+			}
+			if r.Below != nil && *r.Clear < *r.Below {
+				return nil, fmt.Errorf("rules: rule %q clear level must not be below threshold", r.Name)
+			}
+		}
+	}
+	return &rs, nil
+}
+
+// Load replaces the current rule set with one from a remote source, HTTP or
+// the twin, rules that keep their name keep their state.
+// Rule sets with actions that aren't allowed are refused.
+func (e *RuleEngine) Load(b []byte) error {
+	return e.load(b, false)
+}
+
+func (e *RuleEngine) load(b []byte, local bool) error {
+	rs, err := parseRules(b)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !local {
+		for _, r := range rs.Rules {
+			if r.Action != "" && !e.allowed[r.Action] {
+				return fmt.Errorf("rules: rule %q action %q not allowed, only the local rules file may set any action", r.Name, r.Action)
+			}
+		}
+	}
+	active := make(map[string]bool, len(rs.Rules))
+	for _, r := range rs.Rules {
+		active[r.Name] = e.active[r.Name]
+	}
+	e.set, e.raw, e.active = *rs, b, active
+	log.Printf("rules: loaded %d rules\n", len(rs.Rules))
+	return nil
+}
+
+// LoadFile loads the rule set from a local YAML file, its actions are trusted.
+func (e *RuleEngine) LoadFile(name string) error {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return e.load(b, true)
+}
+
+// Raw returns the YAML source of the current rule set.
+func (e *RuleEngine) Raw() []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.raw
+}
+
+// Evaluate runs all rules against the telemetry document.
+// Documents without a numeric value for a rule's field leave its state unchanged.
+func (e *RuleEngine) Evaluate(doc map[string]interface{}) Decision {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	d := Decision{Properties: map[string]string{}}
+	for _, r := range e.set.Rules {
+		v, ok := toFloat(lookupField(doc, r.Field))
+		if !ok {
+			continue
+		}
+		was := e.active[r.Name]
+		now := r.next(was, v)
+		e.active[r.Name] = now
+
+		if now && !was {
+			if r.Alert != "" {
+				d.Alerts = append(d.Alerts, Alert{
+					Rule:    r.Name,
+					Field:   r.Field,
+					Value:   v,
+					Message: r.Alert,
+					Time:    time.Now().UTC(),
+				})
+			}
+			if r.Action != "" {
+				go runAction(r, v)
+			}
+		}
+		props := r.Otherwise
+		if now {
+			props = r.Properties
+			d.Suppress = d.Suppress || r.Suppress
+		}
+		for k, pv := range props {
+			d.Properties[k] = pv
+		}
+	}
+	return d
+}
+
+// next returns the rule state after seeing v, given the previous state.
+func (r *Rule) next(active bool, v float64) bool {
+	if r.Above != nil {
+		if !active {
+			return v > *r.Above
+		}
+		level := *r.Above
+		if r.Clear != nil {
+			level = *r.Clear
+		}
+		return v > level
+	}
+	if !active {
+		return v < *r.Below
+	}
+	level := *r.Below
+	if r.Clear != nil {
+		level = *r.Clear
+	}
+	return v < level
+}
+
+// runAction runs the rule's local action, the rule and the value are passed in environment.
+func runAction(r Rule, v float64) {
+	cmd := exec.Command("/bin/sh", "-c", r.Action)
+	cmd.Env = append(os.Environ(),
+		"RULE_NAME="+r.Name,
+		"RULE_FIELD="+r.Field,
+		fmt.Sprintf("RULE_VALUE=%g", v),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Printf("rules: action for %q failed: %v: %s\n", r.Name, err, strings.TrimSpace(string(out)))
+		return
+	}
+	log.Printf("rules: action for %q done\n", r.Name)
+}
+
+// lookupField returns the value at the dot separated path in the document.
+func lookupField(doc map[string]interface{}, path string) interface{} {
+	var v interface{} = doc
+	for _, k := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// toFloat converts a decoded JSON number to float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// rulesFromDesired extracts a rule set from a twin desired properties document.
+//
+// The rules may be given either as a YAML string or, because twins
+// don't support arrays, as a JSON object keyed by rule name,
+// evaluated in name order. A null, empty string or empty object clears them.
+func rulesFromDesired(desired map[string]interface{}) ([]byte, error) {
+	v, ok := desired["rules"]
+	if !ok {
+		return nil, errNoRules
+	}
+	switch v := v.(type) {
+	case nil:
+		return noRules, nil
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return noRules, nil
+		}
+		return []byte(v), nil
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		rules := make([]interface{}, 0, len(v))
+		for _, name := range names {
+			m, ok := v[name].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("rules: rule %q is not an object", name)
+			}
+			m["name"] = name
+			rules = append(rules, m)
+		}
+		return yaml.Marshal(map[string]interface{}{"rules": rules})
+	}
+	return nil, errNoRules
+}
+
+var errNoRules = errors.New("rules: no rules in desired properties")
+
+// noRules is the empty rule set.
+var noRules = []byte("rules: []\n")
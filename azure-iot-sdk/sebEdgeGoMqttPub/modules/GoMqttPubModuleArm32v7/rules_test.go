@@ -0,0 +1,239 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testRules = `
+rules:
+  - name: hot
+    field: temperature
+    above: 30
+    clear: 28
+    properties: {hot: "true"}
+    otherwise: {hot: "false"}
+    alert: too hot
+  - name: dry
+    field: humidity.min
+    below: 20
+    suppress: true
+`
+
+func TestRuleHysteresis(t *testing.T) {
+	e := &RuleEngine{}
+	if err := e.LoadFile(writeRules(t, testRules)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		temperature float64
+		hot         string
+		alert       bool
+	}{
+		{25, "false", false},
+		{30, "false", false}, // not above yet
+		{31, "true", true},
+		{29, "true", false}, // inside the band, stays active
+		{31, "true", false}, // no second alert while active
+		{28, "false", false},
+		{29, "false", false}, // inside the band, stays inactive
+		{30.5, "true", true},
+	}
+	for i, tt := range tests {
+		d := e.Evaluate(map[string]interface{}{"temperature": tt.temperature})
+		if d.Properties["hot"] != tt.hot || (len(d.Alerts) == 1) != tt.alert || d.Suppress {
+			t.Fatalf("reading %d, %v: %+v, want hot %s alert %v", i, tt.temperature, d, tt.hot, tt.alert)
+		}
+		if tt.alert && (d.Alerts[0].Rule != "hot" || d.Alerts[0].Value != tt.temperature || d.Alerts[0].Message != "too hot") {
+			t.Fatalf("alert = %+v", d.Alerts[0])
+		}
+	}
+
+	// nested field, below, no clear level, suppress while active
+	for _, tt := range []struct {
+		min      float64
+		suppress bool
+	}{{25, false}, {19, true}, {19.9, true}, {20, false}} {
+		d := e.Evaluate(map[string]interface{}{"humidity": map[string]interface{}{"min": tt.min}})
+		if d.Suppress != tt.suppress {
+			t.Fatalf("humidity.min %v: suppress %v, want %v", tt.min, d.Suppress, tt.suppress)
+		}
+	}
+
+	// documents without the field leave the state as it is
+	e.Evaluate(map[string]interface{}{"temperature": 35.0})
+	if d := e.Evaluate(map[string]interface{}{"temperature": "n/a"}); d.Properties["hot"] != "" {
+		t.Fatalf("non-numeric reading: %+v, want the rule skipped", d)
+	}
+	if d := e.Evaluate(map[string]interface{}{"temperature": 29.0}); d.Properties["hot"] != "true" {
+		t.Fatalf("after a skipped reading: %+v, want still active", d)
+	}
+
+	// rules keeping their name keep their state across reloads
+	if err := e.Load([]byte(testRules)); err != nil {
+		t.Fatal(err)
+	}
+	if d := e.Evaluate(map[string]interface{}{"temperature": 29.0}); d.Properties["hot"] != "true" || len(d.Alerts) != 0 {
+		t.Fatalf("after a reload: %+v, want still active without an alert", d)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	for name, b := range map[string]string{
+		"no name":        "rules: [{field: t, above: 1}]",
+		"duplicate name": "rules: [{name: a, field: t, above: 1}, {name: a, field: t, above: 2}]",
+		"no field":       "rules: [{name: a, above: 1}]",
+		"no threshold":   "rules: [{name: a, field: t}]",
+		"two thresholds": "rules: [{name: a, field: t, above: 1, below: 0}]",
+		"clear above":    "rules: [{name: a, field: t, above: 1, clear: 2}]",
+		"clear below":    "rules: [{name: a, field: t, below: 1, clear: 0}]",
+		"unknown key":    "rules: [{name: a, field: t, above: 1, above_or_equal: 1}]",
+	} {
+		if _, err := parseRules([]byte(b)); err == nil {
+			t.Errorf("parseRules with %s: want an error", name)
+		}
+	}
+	if rs, err := parseRules(noRules); err != nil || len(rs.Rules) != 0 {
+		t.Fatalf("parseRules(noRules) = %v, %v, want no rules", rs, err)
+	}
+}
+
+func TestRuleActionAllowlist(t *testing.T) {
+	const withAction = `rules: [{name: a, field: t, above: 1, action: "logger -t gomqttpub alert"}]`
+	e := &RuleEngine{}
+	if err := e.Load([]byte(withAction)); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Fatalf("Load of a rule with an action: err = %v, want not allowed", err)
+	}
+	if len(e.Raw()) != 0 {
+		t.Fatalf("refused rules loaded: %s", e.Raw())
+	}
+	if err := e.LoadFile(writeRules(t, withAction)); err != nil {
+		t.Fatalf("LoadFile of a rule with an action: %v", err)
+	}
+
+	e.AllowActions([]string{"logger -t gomqttpub alert"})
+	if err := e.Load([]byte(withAction)); err != nil {
+		t.Fatalf("Load of a rule with an allowed action: %v", err)
+	}
+	if err := e.Load([]byte(`rules: [{name: a, field: t, above: 1, action: "rm -rf /"}]`)); err == nil {
+		t.Fatal("Load of a rule with another action: want an error")
+	}
+	if string(e.Raw()) != withAction {
+		t.Fatalf("rules after a refused load = %s, want the allowed ones kept", e.Raw())
+	}
+}
+
+func TestRulesFromDesired(t *testing.T) {
+	b, err := rulesFromDesired(map[string]interface{}{"rules": map[string]interface{}{
+		"b": map[string]interface{}{"field": "humidity", "below": 20.0},
+		"a": map[string]interface{}{"field": "temperature", "above": 30.0},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := parseRules(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.Rules) != 2 || rs.Rules[0].Name != "a" || rs.Rules[1].Name != "b" {
+		t.Fatalf("rules = %+v, want a then b", rs.Rules)
+	}
+
+	if b, err := rulesFromDesired(map[string]interface{}{"rules": testRules}); err != nil || string(b) != testRules {
+		t.Fatalf("YAML string rules = %s, %v", b, err)
+	}
+	for _, v := range []interface{}{nil, "", " \n", map[string]interface{}{}} {
+		b, err := rulesFromDesired(map[string]interface{}{"rules": v})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rs, err := parseRules(b); err != nil || len(rs.Rules) != 0 {
+			t.Fatalf("rules %#v = %s, want none", v, b)
+		}
+	}
+	if _, err := rulesFromDesired(map[string]interface{}{"other": 1}); err != errNoRules {
+		t.Fatalf("without rules: err = %v, want errNoRules", err)
+	}
+	if _, err := rulesFromDesired(map[string]interface{}{"rules": map[string]interface{}{"a": 1}}); err == nil {
+		t.Fatal("rule that isn't an object: want an error")
+	}
+}
+
+func TestDesiredRules(t *testing.T) {
+	defer func(e *RuleEngine) { ruleEngine = e }(ruleEngine)
+	ruleEngine = &RuleEngine{}
+	const local = "rules: [{name: local, field: t, above: 1}]"
+	if err := ruleEngine.Load([]byte(local)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a twin without rules leaves other rules alone
+	desiredHandler(map[string]interface{}{"other": 1})
+	if string(ruleEngine.Raw()) != local {
+		t.Fatalf("rules = %s, want the local ones", ruleEngine.Raw())
+	}
+	desiredHandler(map[string]interface{}{"rules": testRules})
+	if string(ruleEngine.Raw()) != testRules {
+		t.Fatalf("rules = %s, want the twin's", ruleEngine.Raw())
+	}
+	// set to null, the property is gone from the twin
+	desiredHandler(map[string]interface{}{"other": 1})
+	if rs, _ := parseRules(ruleEngine.Raw()); len(rs.Rules) != 0 {
+		t.Fatalf("rules = %s, want cleared", ruleEngine.Raw())
+	}
+	desiredHandler(map[string]interface{}{"rules": testRules})
+	desiredHandler(map[string]interface{}{"rules": ""})
+	if rs, _ := parseRules(ruleEngine.Raw()); len(rs.Rules) != 0 {
+		t.Fatalf("rules = %s, want cleared", ruleEngine.Raw())
+	}
+}
+
+func TestRulesAuthorized(t *testing.T) {
+	defer func(token string) { rulesToken = token }(rulesToken)
+	tests := []struct {
+		token, remote, auth string
+		ok                  bool
+	}{
+		{"", "127.0.0.1:5000", "", true},
+		{"", "[::1]:5000", "", true},
+		{"", "172.18.0.1:5000", "", false},
+		{"s3cret", "172.18.0.1:5000", "Bearer s3cret", true},
+		{"s3cret", "172.18.0.1:5000", "Bearer wrong", false},
+		{"s3cret", "172.18.0.1:5000", "s3cret", false},
+		{"s3cret", "127.0.0.1:5000", "", false}, // a set token is needed from localhost too
+	}
+	for _, tt := range tests {
+		rulesToken = tt.token
+		r := httptest.NewRequest("PUT", "/rules", nil)
+		r.RemoteAddr = tt.remote
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		if ok := rulesAuthorized(r); ok != tt.ok {
+			t.Errorf("token %q from %s with %q: authorized %v, want %v", tt.token, tt.remote, tt.auth, ok, tt.ok)
+		}
+	}
+}
+
+func TestLookupField(t *testing.T) {
+	doc := map[string]interface{}{"a": map[string]interface{}{"b": 1.5}, "c": "x"}
+	for path, want := range map[string]interface{}{"a.b": 1.5, "c": "x", "a.x": nil, "c.d": nil, "z": nil} {
+		if got := lookupField(doc, path); !reflect.DeepEqual(got, want) {
+			t.Errorf("lookupField(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+// writeRules writes a rules file to a temporary directory.
+func writeRules(t *testing.T, rules string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := ioutil.WriteFile(name, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
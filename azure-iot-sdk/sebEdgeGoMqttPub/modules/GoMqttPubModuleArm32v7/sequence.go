@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Message properties stamped on every message for gap detection.
+const (
+	PropSeq    = "seq"
+	PropBootID = "boot-id"
+)
+
+// sequenceBlock is how many sequence numbers are reserved per state file write.
+const sequenceBlock = 1000
+
+// Sequence is the device's message sequence number, it keeps increasing
+// across restarts. Numbers are reserved a block at a time in the state file,
+// so it's only written once per block, and a restart continues after the
+// reserved block, skipping its unused numbers. The boot ID tells restarts apart.
+type Sequence struct {
+	mu       sync.Mutex
+	file     string
+	last     uint64
+	reserved uint64 // numbers up to this one may be used without saving
+	bootID   string
+}
+
+// newSequence restores the sequence number from the state file and starts a new boot.
+func newSequence(file string) (*Sequence, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	s := &Sequence{file: file, bootID: hex.EncodeToString(b)}
+
+	state, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	var saved struct {
+		Last uint64 `json:"last"` // the end of the last reserved block
+	}
+	if err := json.Unmarshal(state, &saved); err != nil {
+		return nil, err
+	}
+	s.last, s.reserved = saved.Last, saved.Last
+	return s, nil
+}
+
+// Next takes the next sequence number and returns it with the boot ID as message properties.
+func (s *Sequence) Next() (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.last >= s.reserved {
+		b, err := json.Marshal(struct {
+			Last uint64 `json:"last"`
+		}{s.last + sequenceBlock})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(s.file, b); err != nil {
+			return nil, err
+		}
+		s.reserved = s.last + sequenceBlock
+	}
+	s.last++
+
+	return map[string]string{
+		PropSeq:    strconv.FormatUint(s.last, 10),
+		PropBootID: s.bootID,
+	}, nil
+}
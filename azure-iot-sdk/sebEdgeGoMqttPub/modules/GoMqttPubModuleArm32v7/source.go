@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// SourceConfig configures a source of readings and how they are published.
+//
+// Example sources.yaml:
+//
+//	sources:
+//	  - name: sim
+//	    type: simulated
+//	    interval: 10s
+//	    aggregate:
+//	      temperature: {window: tumbling, size: 1m}
+//	      humidity: {window: sliding, size: 5m, every: 1m}
+//	    passthrough: [temperature]
+//	    deadband:
+//	      temperature: {absolute: 0.5, percent: 2}
+//	    heartbeat: 5m
+//	    encoding: cbor
+//	    batch: {size: 10, interval: 2m}
+//	    compression: zstd
+//	    sign: ed-2021-04
+//	  - name: adc
+//	    type: sysfs
+//	    interval: 1s
+//	    fields:
+//	      light: /sys/bus/iio/devices/iio:device0/in_voltage0_raw
+//	    aggregate:
+//	      light: {window: tumbling, size: 30s}
+//	    encoding: protobuf
+//	    schema: beagle.Light
+type SourceConfig struct {
+	Name string `yaml:"name"`
+
+	// Type is either simulated (like the NodeJS SimulatedDevice) or sysfs.
+	Type     string        `yaml:"type"`
+	Interval time.Duration `yaml:"interval"`
+
+	// Fields maps field names to the files sysfs readings are taken from.
+	Fields map[string]string `yaml:"fields,omitempty"`
+
+	// Aggregate configures windows per field, aggregated fields are
+	// only published at the window end unless listed in Passthrough.
+	Aggregate   map[string]WindowConfig `yaml:"aggregate,omitempty"`
+	Passthrough []string                `yaml:"passthrough,omitempty"`
+
+	// Deadband configures report-by-exception of raw readings per field,
+	// Heartbeat is the longest time a field goes unsent regardless.
+	Deadband  map[string]DeadbandConfig `yaml:"deadband,omitempty"`
+	Heartbeat time.Duration             `yaml:"heartbeat,omitempty"`
+
+	// Encoding of the payloads, json (default), cbor, protobuf or avro,
+	// Schema names the protobuf message type or avro schema in the registry.
+	Encoding string `yaml:"encoding,omitempty"`
+	Schema   string `yaml:"schema,omitempty"`
+
+	// Batch sends several documents in one message,
+	// Compression is either gzip or zstd.
+	Batch       BatchConfig `yaml:"batch,omitempty"`
+	Compression string      `yaml:"compression,omitempty"`
+
+	// Sign and Encrypt are the IDs of the keyring keys messages are signed
+	// (hmac or ed25519) and encrypted (aes) with.
+	Sign    string `yaml:"sign,omitempty"`
+	Encrypt string `yaml:"encrypt,omitempty"`
+
+	codec Codec
+}
+
+// SourcesConfig is the YAML document holding all sources.
+type SourcesConfig struct {
+	Sources []SourceConfig `yaml:"sources"`
+}
+
+// defaultSources keeps the original behaviour, a simulated reading every 10 seconds.
+var defaultSources = []SourceConfig{
+	{Name: "sim", Type: "simulated", Interval: 10 * time.Second},
+}
+
+// loadSources reads and validates the sources file.
+func loadSources(name string) ([]SourceConfig, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var sc SourcesConfig
+	if err := yaml.UnmarshalStrict(b, &sc); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(sc.Sources))
+	for _, s := range sc.Sources {
+		if s.Name == "" || names[s.Name] {
+			return nil, fmt.Errorf("sources: missing or duplicate source name %q", s.Name)
+		}
+		names[s.Name] = true
+		if s.Type != "simulated" && s.Type != "sysfs" {
+			return nil, fmt.Errorf("sources: source %q has unknown type %q", s.Name, s.Type)
+		}
+		if s.Interval <= 0 {
+			return nil, fmt.Errorf("sources: source %q needs an interval", s.Name)
+		}
+		for f, w := range s.Aggregate {
+			if err := w.validate(); err != nil {
+				return nil, fmt.Errorf("sources: source %q field %q: %v", s.Name, f, err)
+			}
+		}
+		for f, db := range s.Deadband {
+			if err := db.validate(); err != nil {
+				return nil, fmt.Errorf("sources: source %q field %q: %v", s.Name, f, err)
+			}
+		}
+		if s.Heartbeat < 0 {
+			return nil, fmt.Errorf("sources: source %q heartbeat must not be negative", s.Name)
+		}
+		if err := s.Batch.validate(); err != nil {
+			return nil, fmt.Errorf("sources: source %q: %v", s.Name, err)
+		}
+		if s.Compression != "" && s.Compression != ContentEncodingGzip && s.Compression != ContentEncodingZstd {
+			return nil, fmt.Errorf("sources: source %q has unknown compression %q", s.Name, s.Compression)
+		}
+	}
+	return sc.Sources, nil
+}
+
+// read takes one set of readings from the source.
+func (s *SourceConfig) read() (map[string]float64, error) {
+	if s.Type == "simulated" {
+		return map[string]float64{
+			"temperature": 20 + rand.Float64()*15,
+			"humidity":    60 + rand.Float64()*20,
+		}, nil
+	}
+	readings := make(map[string]float64, len(s.Fields))
+	for f, path := range s.Fields {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(string(b)), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		readings[f] = v
+	}
+	return readings, nil
+}
+
+// aggregateSaveInterval is the longest the aggregation state goes unsaved
+// while windows are open, it's saved as windows close and on shutdown too,
+// not on every reading, sparing the flash storage.
+const aggregateSaveInterval = time.Minute
+
+// runSource reads the source on its interval, publishing raw readings
+// and aggregated windows as they close, until stop is closed.
+func runSource(s SourceConfig, stateDir string, stop <-chan struct{}) {
+	agg, err := newAggregator(s.Aggregate, filepath.Join(stateDir, "aggregate-"+s.Name+".json"))
+	if err != nil {
+		log.Printf("source %s: restoring aggregation state: %v\n", s.Name, err)
+	}
+	passthrough := make(map[string]bool, len(s.Passthrough))
+	for _, f := range s.Passthrough {
+		passthrough[f] = true
+	}
+	deadband := newDeadband(s.Name, s.Deadband, s.Heartbeat)
+	out := newBatcher(&s)
+
+	saved := time.Now()
+	save := func(now time.Time) {
+		if err := agg.Save(); err != nil {
+			log.Printf("source %s: saving aggregation state: %v\n", s.Name, err)
+		}
+		saved = now
+	}
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-stop:
+			save(time.Now())
+			return
+		}
+		out.FlushDue(now)
+
+		// windows ending since the last reading are published first,
+		// so a window closes at most one interval late
+		if stats := agg.Flush(now); len(stats) != 0 {
+			doc := newDocument(s.Name, now)
+			for f, st := range stats {
+				doc[f] = st
+			}
+			publishTelemetry(now, doc, out)
+			save(now)
+		}
+
+		readings, err := s.read()
+		if err != nil {
+			log.Printf("source %s: read error: %v\n", s.Name, err)
+			continue
+		}
+		raw := make(map[string]float64, len(readings))
+		for f, v := range readings {
+			if _, ok := s.Aggregate[f]; ok {
+				agg.Add(f, now, v)
+				if !passthrough[f] {
+					continue
+				}
+			}
+			raw[f] = v
+		}
+		if now.Sub(saved) >= aggregateSaveInterval {
+			save(now)
+		}
+		if len(raw) == 0 || !deadband.Filter(now, raw) {
+			continue
+		}
+		doc := newDocument(s.Name, now)
+		for f, v := range raw {
+			doc[f] = v
+		}
+		publishTelemetry(now, doc, out)
+	}
+}
+
+// checkKeys checks the source's signing and encryption keys are in the keyring.
+func (s *SourceConfig) checkKeys(kr *Keyring) error {
+	if s.Sign != "" {
+		_, errHMAC := kr.Lookup(s.Sign, KeyHMAC)
+		k, errEd := kr.Lookup(s.Sign, KeyEd25519)
+		if errHMAC != nil && (errEd != nil || k.priv == nil) {
+			return fmt.Errorf("sources: source %q: %q is not an hmac or ed25519 private key", s.Name, s.Sign)
+		}
+	}
+	if s.Encrypt != "" {
+		if _, err := kr.Lookup(s.Encrypt, KeyAES); err != nil {
+			return fmt.Errorf("sources: source %q: %v", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// newDocument returns a telemetry document without readings.
+func newDocument(source string, t time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"deviceId": DeviceID,
+		"source":   source,
+		"time":     t.UTC().Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Device twin over MQTT.
+// See: https://docs.microsoft.com/en-us/azure/iot-hub/iot-hub-mqtt-support#retrieving-a-device-twins-properties
+const (
+	twinResponseTopic = "$iothub/twin/res/#"
+	twinDesiredTopic  = "$iothub/twin/PATCH/properties/desired/#"
+	twinGetTopic      = "$iothub/twin/GET/?$rid=%d"
+)
+
+var twinRid int64
+
+// DesiredHandler handles the full set of twin desired properties.
+type DesiredHandler func(desired map[string]interface{})
+
+// subscribeTwin subscribes to twin responses and desired properties updates
+// and requests the full twin, fn is called with desired properties every time
+// the twin is received. It has to be called again after every reconnect.
+func subscribeTwin(client mqtt.Client, fn DesiredHandler) error {
+	onResponse := func(client mqtt.Client, msg mqtt.Message) {
+		// $iothub/twin/res/{status}/?$rid={request id}
+		status := strings.SplitN(strings.TrimPrefix(msg.Topic(), "$iothub/twin/res/"), "/", 2)[0]
+		if status != "200" {
+			log.Printf("twin: response status %s on %s\n", status, msg.Topic())
+			return
+		}
+		var twin struct {
+			Desired map[string]interface{} `json:"desired"`
+		}
+		if err := json.Unmarshal(msg.Payload(), &twin); err != nil {
+			log.Printf("twin: %v\n", err)
+			return
+		}
+		fn(twin.Desired)
+	}
+
+	// patches contain changed properties only, so the full twin is requested again
+	onDesired := func(client mqtt.Client, msg mqtt.Message) {
+		log.Printf("twin: desired properties updated: %s\n", msg.Payload())
+		// not waiting for the publish token inside the message handler
+		go func() {
+			if err := requestTwin(client); err != nil {
+				log.Printf("twin: %v\n", err)
+			}
+		}()
+	}
+
+	if token := client.Subscribe(twinResponseTopic, DefaultMqttQoS, onResponse); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	if token := client.Subscribe(twinDesiredTopic, DefaultMqttQoS, onDesired); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return requestTwin(client)
+}
+
+// requestTwin requests the full device twin, the response arrives on twinResponseTopic.
+func requestTwin(client mqtt.Client) error {
+	topic := fmt.Sprintf(twinGetTopic, atomic.AddInt64(&twinRid, 1))
+	token := client.Publish(topic, DefaultMqttQoS, false, "")
+	token.Wait()
+	return token.Error()
+}
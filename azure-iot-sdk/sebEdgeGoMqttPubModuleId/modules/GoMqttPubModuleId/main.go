@@ -56,6 +56,7 @@ func init() {
 
 	// TODO: Need to manually generate SAS for now
 	// az iot hub generate-sas-token -d sebEdgeDevice -m NodeJsModuleId -n seb-hub --du 28800
+	// or without az CLI, see go/sas: sas module -host seb-hub.azure-devices.net -device sebEdgeDevice -module NodeJsModuleId -key <module key> -du 8h
 	// then CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -o gomqttpubmoduleid main.go
 	// Monitor event hub from ~/go/src/github.com/sebmaspd/rnd/azure/iot/sebEdgeDevice/eventhub
 	opts.SetPassword(
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/Azure/go-amqp"
+)
+
+// amqpConn is the client's AMQP connection to the hub, authenticated by CBS
+// tokens that the token manager renews in the background until it's closed.
+type amqpConn struct {
+	conn   *amqp.Client
+	tokens *TokenManager
+
+	mu  sync.Mutex
+	err error // the token error the connection was closed on
+}
+
+// amqpSession returns a new session on the client's AMQP connection,
+// the connection is established on first use, and again after its token
+// couldn't be renewed, unless the hub refused it.
+func (c *Client) amqpSession(ctx context.Context) (*amqp.Session, error) {
+	c.amqpMu.Lock()
+	defer c.amqpMu.Unlock()
+	if c.amqp != nil {
+		if err := c.amqp.failed(); err != nil {
+			c.amqp = nil
+			var terr *TokenError
+			if errors.As(err, &terr) && terr.fatal() {
+				return nil, err
+			}
+		}
+	}
+	if c.amqp == nil {
+		conn, err := c.dialAMQP(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.amqp = conn
+	}
+	return c.amqp.conn.NewSession()
+}
+
+func (c *Client) dialAMQP(ctx context.Context) (*amqpConn, error) {
+	conn, err := amqp.Dial("amqps://"+c.sak.HostName,
+		amqp.ConnTLSConfig(&tls.Config{ServerName: c.sak.HostName}),
+		amqp.ConnSASLAnonymous(),
+		amqp.ConnProperty("com.microsoft:client-version", userAgent),
+	)
+	if err != nil {
+		return nil, err
+	}
+	ac := &amqpConn{conn: conn, tokens: NewTokenManager(context.Background(), conn, c.sak)}
+	if err := ac.tokens.Put(ctx, c.sak.HostName); err != nil {
+		ac.tokens.Close()
+		conn.Close()
+		return nil, err
+	}
+	go ac.watch()
+	return ac, nil
+}
+
+// watch closes the connection when its token can't be renewed, so links
+// fail now rather than when the token expires, and keeps the error for
+// amqpSession to tell.
+func (ac *amqpConn) watch() {
+	var err error
+	select {
+	case err = <-ac.tokens.Err():
+	case <-ac.tokens.done:
+		// closed, or gave up, the error is sent before done is closed
+		select {
+		case err = <-ac.tokens.Err():
+		default:
+			return
+		}
+	}
+	log.Printf("closing AMQP connection: %v\n", err)
+	ac.mu.Lock()
+	ac.err = err
+	ac.mu.Unlock()
+	ac.conn.Close()
+}
+
+func (ac *amqpConn) failed() error {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.err
+}
+
+// Close closes the client's AMQP connection, REST calls still work afterwards.
+func (c *Client) Close() error {
+	c.amqpMu.Lock()
+	defer c.amqpMu.Unlock()
+	if c.amqp == nil {
+		return nil
+	}
+	c.amqp.tokens.Close()
+	err := c.amqp.conn.Close()
+	c.amqp = nil
+	return err
+}
+
+// checkMessageResponse checks for 200 response code otherwise returns an error.
+func checkMessageResponse(msg *amqp.Message) error {
+	rc, ok := msg.ApplicationProperties["status-code"].(int32)
+	if !ok {
+		return errors.New("unable to typecast status-code")
+	}
+	if rc == 200 {
+		return nil
+	}
+	rd, _ := msg.ApplicationProperties["status-description"].(string)
+	return fmt.Errorf("code = %d, description = %q", rc, rd)
+}
+
+func genID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ManifestEntry is a device of an import manifest, or of an export.
+//
+// In CSV manifests the first row names the columns, tags are
+// tag.<name> columns, e.g.
+//
+//	deviceId,auth,edge,tag.site,tag.floor
+//	beagle-001,sas,false,plant1,2
+type ManifestEntry struct {
+	DeviceID            string                 `json:"deviceId"`
+	Auth                string                 `json:"auth,omitempty"`
+	PrimaryThumbprint   string                 `json:"primaryThumbprint,omitempty"`
+	SecondaryThumbprint string                 `json:"secondaryThumbprint,omitempty"`
+	Status              string                 `json:"status,omitempty"`
+	Edge                bool                   `json:"edge,omitempty"`
+	Tags                map[string]interface{} `json:"tags,omitempty"`
+}
+
+// ImportResult is the outcome of importing a device.
+type ImportResult struct {
+	DeviceID         string `json:"deviceId"`
+	Action           string `json:"action"` // created, updated, unchanged, derived or failed
+	ConnectionString string `json:"connectionString,omitempty"`
+	DerivedKey       string `json:"derivedKey,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// readManifest reads a JSON array or CSV manifest, by file extension.
+func readManifest(name string) ([]*ManifestEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*ManifestEntry
+	if strings.EqualFold(filepath.Ext(name), ".csv") {
+		entries, err = readManifestCSV(f)
+	} else {
+		var b []byte
+		if b, err = ioutil.ReadAll(f); err == nil {
+			err = json.Unmarshal(b, &entries)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(entries))
+	for i, e := range entries {
+		if e.DeviceID == "" {
+			return nil, errorf("manifest entry %d has no deviceId", i+1)
+		}
+		if seen[e.DeviceID] {
+			return nil, errorf("manifest lists %q twice", e.DeviceID)
+		}
+		seen[e.DeviceID] = true
+	}
+	return entries, nil
+}
+
+func readManifestCSV(r io.Reader) ([]*ManifestEntry, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	header := rows[0]
+	entries := make([]*ManifestEntry, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		e := &ManifestEntry{}
+		for i, v := range row {
+			v = strings.TrimSpace(v)
+			switch col := strings.TrimSpace(header[i]); {
+			case col == "deviceId":
+				e.DeviceID = v
+			case col == "auth":
+				e.Auth = v
+			case col == "primaryThumbprint":
+				e.PrimaryThumbprint = v
+			case col == "secondaryThumbprint":
+				e.SecondaryThumbprint = v
+			case col == "status":
+				e.Status = v
+			case col == "edge":
+				if v != "" {
+					if e.Edge, err = strconv.ParseBool(v); err != nil {
+						return nil, errorf("device %q: bad edge value %q", e.DeviceID, v)
+					}
+				}
+			case strings.HasPrefix(col, "tag.") && v != "":
+				if e.Tags == nil {
+					e.Tags = map[string]interface{}{}
+				}
+				e.Tags[strings.TrimPrefix(col, "tag.")] = v
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// importDevices creates or updates the devices of the manifest, at most
+// concurrency at a time. Existing devices keep their keys, they're only
+// updated when their authentication type, status or edge capability differ.
+// Results are in manifest order.
+func importDevices(ctx context.Context, c *Client, entries []*ManifestEntry, concurrency int) []*ImportResult {
+	results := make([]*ImportResult, len(entries))
+	forEach(len(entries), concurrency, func(i int) {
+		results[i] = importDevice(ctx, c, entries[i])
+	})
+	return results
+}
+
+func importDevice(ctx context.Context, c *Client, e *ManifestEntry) *ImportResult {
+	res := &ImportResult{DeviceID: e.DeviceID}
+	fail := func(err error) *ImportResult {
+		res.Action, res.Error = "failed", err.Error()
+		return res
+	}
+
+	want, err := newAuthentication(e.Auth, e.PrimaryThumbprint, e.SecondaryThumbprint)
+	if err != nil {
+		return fail(err)
+	}
+	status := e.Status
+	if status == "" {
+		status = StatusEnabled
+	}
+
+	d, err := c.GetDevice(ctx, e.DeviceID)
+	switch {
+	case isStatus(err, http.StatusNotFound):
+		d = &Device{DeviceID: e.DeviceID, Status: status, Authentication: want}
+		if e.Edge {
+			d.Capabilities = map[string]interface{}{"iotEdge": true}
+		}
+		if d, err = c.CreateDevice(ctx, d); err != nil {
+			return fail(err)
+		}
+		res.Action = "created"
+	case err != nil:
+		return fail(err)
+	default:
+		res.Action = "unchanged"
+		sameAuth := sameAuthentication(d.Authentication, want)
+		if !sameAuth || d.Status != status || isEdge(d) != e.Edge {
+			if !sameAuth {
+				d.Authentication = want
+			}
+			d.Status = status
+			d.Capabilities = map[string]interface{}{"iotEdge": e.Edge}
+			if d, err = c.UpdateDevice(ctx, d); err != nil {
+				return fail(err)
+			}
+			res.Action = "updated"
+		}
+	}
+
+	if len(e.Tags) != 0 {
+		if _, err := c.UpdateTwin(ctx, e.DeviceID, &Twin{Tags: e.Tags}); err != nil {
+			return fail(err)
+		}
+	}
+	res.ConnectionString = d.ConnectionString(c.HostName())
+	return res
+}
+
+// sameAuthentication reports whether have is of the type and thumbprints of want,
+// keys aren't compared, IoT Hub generates them.
+func sameAuthentication(have, want *Authentication) bool {
+	if have == nil || have.Type != want.Type {
+		return false
+	}
+	if want.Type != AuthSelfSigned {
+		return true
+	}
+	return have.X509Thumbprint != nil && *have.X509Thumbprint == *want.X509Thumbprint
+}
+
+func isEdge(d *Device) bool {
+	edge, _ := d.Capabilities["iotEdge"].(bool)
+	return edge
+}
+
+// deriveKeys derives the DPS device keys of the manifest from the enrollment
+// group key, the devices are created by DPS when they first register.
+func deriveKeys(entries []*ManifestEntry, groupKey string) []*ImportResult {
+	results := make([]*ImportResult, 0, len(entries))
+	for _, e := range entries {
+		res := &ImportResult{DeviceID: e.DeviceID, Action: "derived"}
+		key, err := DeriveKey(groupKey, e.DeviceID)
+		if err != nil {
+			res.Action, res.Error = "failed", err.Error()
+		}
+		res.DerivedKey = key
+		results = append(results, res)
+	}
+	return results
+}
+
+// exportDevices returns the registry as manifest entries, with the tags of
+// the device twins, paging through a twin query of all devices.
+func exportDevices(ctx context.Context, c *Client) ([]*ManifestEntry, error) {
+	var entries []*ManifestEntry
+	err := c.QueryTwins(ctx, "SELECT * FROM devices", 100, func(t *Twin) error {
+		e := &ManifestEntry{DeviceID: t.DeviceID, Status: t.Status, Tags: t.Tags, Auth: t.AuthenticationType}
+		e.Edge, _ = t.Capabilities["iotEdge"].(bool)
+		if th := t.X509Thumbprint; th != nil && e.Auth == AuthSelfSigned {
+			e.PrimaryThumbprint, e.SecondaryThumbprint = th.PrimaryThumbprint, th.SecondaryThumbprint
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeviceID < entries[j].DeviceID
+	})
+	return entries, nil
+}
+
+// forEach calls fn for 0 to n-1, at most concurrency calls at a time.
+func forEach(n, concurrency int, fn func(i int)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// createSecret creates or truncates a file only the owner can read,
+// for output holding keys.
+func createSecret(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// an existing file keeps its mode, so tighten it
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeResults writes import results as CSV or JSON, by file extension.
+func writeResults(w io.Writer, name string, results []*ImportResult) error {
+	if !strings.EqualFold(filepath.Ext(name), ".csv") {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"deviceId", "action", "connectionString", "derivedKey", "error"})
+	for _, r := range results {
+		cw.Write([]string{r.DeviceID, r.Action, r.ConnectionString, r.DerivedKey, r.Error})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeManifest writes manifest entries as CSV or JSON, by file extension.
+func writeManifest(w io.Writer, name string, entries []*ManifestEntry) error {
+	if !strings.EqualFold(filepath.Ext(name), ".csv") {
+		b, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	}
+
+	tagSet := map[string]bool{}
+	for _, e := range entries {
+		for k := range e.Tags {
+			tagSet[k] = true
+		}
+	}
+	tags := make([]string, 0, len(tagSet))
+	for k := range tagSet {
+		tags = append(tags, k)
+	}
+	sort.Strings(tags)
+
+	cw := csv.NewWriter(w)
+	header := []string{"deviceId", "auth", "primaryThumbprint", "secondaryThumbprint", "status", "edge"}
+	for _, k := range tags {
+		header = append(header, "tag."+k)
+	}
+	cw.Write(header)
+	for _, e := range entries {
+		row := []string{e.DeviceID, e.Auth, e.PrimaryThumbprint, e.SecondaryThumbprint, e.Status, strconv.FormatBool(e.Edge)}
+		for _, k := range tags {
+			v, ok := e.Tags[k]
+			if s, isString := v.(string); isString || !ok {
+				row = append(row, s)
+				continue
+			}
+			// numbers and nested tags are kept as JSON
+			b, _ := json.Marshal(v)
+			row = append(row, string(b))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// Acknowledgement modes of cloud-to-device messages, which outcomes
+// the hub reports back on the feedback link.
+const (
+	AckNone     = "none"
+	AckPositive = "positive" // completed
+	AckNegative = "negative" // expired, rejected or delivery count exceeded
+	AckFull     = "full"     // both
+)
+
+// Feedback status codes.
+const (
+	FeedbackSuccess               = "Success"
+	FeedbackExpired               = "Expired"
+	FeedbackDeliveryCountExceeded = "DeliveryCountExceeded"
+	FeedbackRejected              = "Rejected"
+	FeedbackPurged                = "Purged"
+)
+
+// C2DMessage is a cloud-to-device message.
+type C2DMessage struct {
+	DeviceID      string
+	MessageID     string // generated when empty
+	CorrelationID string
+	UserID        string
+	ExpiryTime    time.Time // the hub's default expiry when zero
+	Ack           string    // none when empty
+	Properties    map[string]string
+	Payload       []byte
+}
+
+// Feedback is a delivery outcome of a cloud-to-device message.
+type Feedback struct {
+	OriginalMessageID  string    `json:"originalMessageId"`
+	DeviceID           string    `json:"deviceId"`
+	DeviceGenerationID string    `json:"deviceGenerationId"`
+	EnqueuedTime       time.Time `json:"enqueuedTimeUtc"`
+	StatusCode         string    `json:"statusCode"`
+	Description        string    `json:"description"`
+
+	// Message is the message sent by this client the feedback is about,
+	// nil if it was sent by someone else or before the client started.
+	Message *C2DMessage `json:"-"`
+}
+
+// FeedbackHandler handles feedback records.
+type FeedbackHandler func(f *Feedback) error
+
+// ErrSkipFeedback is returned by feedback handlers for records they leave to
+// other subscribers, feedback messages holding such records are released
+// for the hub to deliver again instead of being accepted.
+var ErrSkipFeedback = errors.New("iotservice: feedback record skipped")
+
+// pendingFeedback holds sent messages awaiting feedback by message ID.
+type pendingFeedback struct {
+	mu   sync.Mutex
+	msgs map[string]*C2DMessage
+}
+
+func (p *pendingFeedback) add(m *C2DMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.msgs == nil {
+		p.msgs = map[string]*C2DMessage{}
+	}
+	p.msgs[m.MessageID] = m
+}
+
+// get returns the message of the given ID, nil when there's none.
+func (p *pendingFeedback) get(id string) *C2DMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.msgs[id]
+}
+
+// take returns the message of the given ID. Positive and negative outcomes are
+// final, so the message is forgotten once its feedback came in.
+func (p *pendingFeedback) take(id string) *C2DMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := p.msgs[id]
+	delete(p.msgs, id)
+	return m
+}
+
+// handle calls fn for the records of a feedback message, a message is only
+// forgotten once fn handled its record, so skipped records and the ones
+// left after an error still get it on redelivery. It reports whether
+// the feedback message is to be released rather than accepted.
+func (p *pendingFeedback) handle(records []*Feedback, fn FeedbackHandler) (bool, error) {
+	skipped := false
+	for _, f := range records {
+		f.Message = p.get(f.OriginalMessageID)
+		err := fn(f)
+		if err == ErrSkipFeedback {
+			skipped = true
+			continue
+		}
+		if err != nil {
+			return true, err
+		}
+		p.take(f.OriginalMessageID)
+	}
+	return skipped, nil
+}
+
+// SendC2D sends a cloud-to-device message, it's queued by the hub
+// until the device receives it or it expires.
+func (c *Client) SendC2D(ctx context.Context, m *C2DMessage) error {
+	switch m.Ack {
+	case "", AckNone, AckPositive, AckNegative, AckFull:
+	default:
+		return errorf("unknown ack mode %q", m.Ack)
+	}
+	if m.MessageID == "" {
+		m.MessageID = genID()
+	}
+
+	sess, err := c.amqpSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer sess.Close(context.Background())
+	send, err := sess.NewSender(
+		amqp.LinkTargetAddress("/messages/devicebound"),
+	)
+	if err != nil {
+		return err
+	}
+	defer send.Close(context.Background())
+
+	props := make(map[string]interface{}, len(m.Properties)+1)
+	for k, v := range m.Properties {
+		props[k] = v
+	}
+	if m.Ack != "" {
+		props["iothub-ack"] = m.Ack
+	}
+	msg := &amqp.Message{
+		Data: [][]byte{m.Payload},
+		Properties: &amqp.MessageProperties{
+			MessageID: m.MessageID,
+			To:        "/devices/" + m.DeviceID + "/messages/devicebound",
+		},
+		ApplicationProperties: props,
+	}
+	if m.CorrelationID != "" {
+		msg.Properties.CorrelationID = m.CorrelationID
+	}
+	if m.UserID != "" {
+		msg.Properties.UserID = []byte(m.UserID)
+	}
+	if !m.ExpiryTime.IsZero() {
+		msg.Properties.AbsoluteExpiryTime = m.ExpiryTime
+	}
+
+	if m.Ack != "" && m.Ack != AckNone {
+		c.feedback.add(m)
+	}
+	if err := send.Send(ctx, msg); err != nil {
+		c.feedback.take(m.MessageID)
+		return err
+	}
+	return nil
+}
+
+// SubscribeFeedback calls fn for every feedback record until it returns an error
+// or the context is cancelled. Records of messages sent by this client carry
+// the original message. Feedback messages are only accepted once fn handled
+// all of their records, fn returns ErrSkipFeedback to leave a record to others.
+// Released feedback messages are delivered again as a whole, so records
+// handled before a skip or an error may be delivered more than once,
+// without their original message the second time.
+//
+// The hub has one feedback queue, competing subscribers each get a part of it.
+func (c *Client) SubscribeFeedback(ctx context.Context, fn FeedbackHandler) error {
+	sess, err := c.amqpSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer sess.Close(context.Background())
+	recv, err := sess.NewReceiver(
+		amqp.LinkSourceAddress("/messages/servicebound/feedback"),
+	)
+	if err != nil {
+		return err
+	}
+	defer recv.Close(context.Background())
+
+	for {
+		msg, err := recv.Receive(ctx)
+		if err != nil {
+			return err
+		}
+		var records []*Feedback
+		if err := json.Unmarshal(msg.GetData(), &records); err != nil {
+			log.Printf("bad feedback message %q: %v\n", msg.GetData(), err)
+			if err := msg.Reject(ctx, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		release, err := c.feedback.handle(records, fn)
+		if err != nil {
+			// released so the records are delivered again
+			_ = msg.Release(ctx)
+			return err
+		}
+		if release {
+			if err := msg.Release(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := msg.Accept(ctx); err != nil {
+			return err
+		}
+	}
+}
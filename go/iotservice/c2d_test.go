@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPendingFeedbackHandle(t *testing.T) {
+	p := &pendingFeedback{}
+	for _, id := range []string{"a", "b", "c"} {
+		p.add(&C2DMessage{MessageID: id})
+	}
+	records := func(ids ...string) []*Feedback {
+		var fs []*Feedback
+		for _, id := range ids {
+			fs = append(fs, &Feedback{OriginalMessageID: id})
+		}
+		return fs
+	}
+	boom := errors.New("boom")
+
+	tests := []struct {
+		name    string
+		records []*Feedback
+		results map[string]error // by message ID, nil handles the record
+		release bool
+		err     error
+		seen    string // records that got their message
+		left    string // messages still awaiting feedback
+	}{
+		{"skip", records("a", "b"), map[string]error{"a": ErrSkipFeedback}, true, nil, "ab", "ac"},
+		{"error", records("c", "a"), map[string]error{"c": boom}, true, boom, "c", "ac"},
+		{"redelivered", records("c", "a", "x"), nil, false, nil, "ca", ""},
+	}
+	for _, tt := range tests {
+		seen := ""
+		release, err := p.handle(tt.records, func(f *Feedback) error {
+			if f.Message != nil {
+				if f.Message.MessageID != f.OriginalMessageID {
+					t.Fatalf("%s: record %s got message %s", tt.name, f.OriginalMessageID, f.Message.MessageID)
+				}
+				seen += f.OriginalMessageID
+			}
+			return tt.results[f.OriginalMessageID]
+		})
+		if release != tt.release || err != tt.err {
+			t.Errorf("%s: handle = %v, %v, want %v, %v", tt.name, release, err, tt.release, tt.err)
+		}
+		if seen != tt.seen {
+			t.Errorf("%s: records with their message %q, want %q", tt.name, seen, tt.seen)
+		}
+		left := ""
+		for _, id := range []string{"a", "b", "c"} {
+			if p.get(id) != nil {
+				left += id
+			}
+		}
+		if left != tt.left {
+			t.Errorf("%s: awaiting feedback %q, want %q", tt.name, left, tt.left)
+		}
+	}
+}
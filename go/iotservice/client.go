@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIVersion is the IoT Hub service REST API version.
+const APIVersion = "2020-09-30"
+
+func errorf(format string, v ...interface{}) error {
+	return fmt.Errorf("iotservice: "+format, v...)
+}
+
+// RequestError is an unsuccessful response of the IoT Hub REST API.
+type RequestError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("iotservice: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// isStatus reports whether err is a RequestError of the given status code.
+func isStatus(err error, code int) bool {
+	rerr, ok := err.(*RequestError)
+	return ok && rerr.StatusCode == code
+}
+
+// ClientOption is a client configuration option.
+type ClientOption func(c *Client)
+
+// WithHTTPClient sets the HTTP client used for REST calls.
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithEndpoint overrides the https://<host> REST endpoint, e.g. for a local stand-in.
+func WithEndpoint(endpoint string) ClientOption {
+	return func(c *Client) {
+		c.endpoint = strings.TrimSuffix(endpoint, "/")
+	}
+}
+
+// Client is an IoT Hub service client authenticated by a shared access policy.
+type Client struct {
+	sak      *SharedAccessKey
+	endpoint string
+	http     *http.Client
+
+	mu    sync.Mutex
+	token *SharedAccessSignature
+
+	amqpMu   sync.Mutex
+	amqp     *amqpConn
+	feedback pendingFeedback
+}
+
+// NewClient returns a client from the service connection string,
+// e.g. HostName=seb-hub.azure-devices.net;SharedAccessKeyName=service;SharedAccessKey=...
+func NewClient(cs string, opts ...ClientOption) (*Client, error) {
+	p, err := ParseConnectionString(cs)
+	if err != nil {
+		return nil, err
+	}
+	if p.HostName == "" || p.SharedAccessKeyName == "" {
+		return nil, errorf("service connection string needs HostName and SharedAccessKeyName")
+	}
+	c := &Client{
+		sak: &SharedAccessKey{
+			HostName:            p.HostName,
+			SharedAccessKeyName: p.SharedAccessKeyName,
+			SharedAccessKey:     p.SharedAccessKey,
+		},
+		endpoint: "https://" + p.HostName,
+		http:     &http.Client{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// HostName is the IoT Hub host name.
+func (c *Client) HostName() string {
+	return c.sak.HostName
+}
+
+// authorization returns the service token, renewed before it expires.
+func (c *Client) authorization() (string, error) {
+	const lifetime = time.Hour
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == nil || time.Until(c.token.Se) < lifetime/4 {
+		sas, err := c.sak.Token(c.sak.HostName, lifetime)
+		if err != nil {
+			return "", err
+		}
+		c.token = sas
+	}
+	return c.token.String(), nil
+}
+
+// defaultTimeout is the timeout of REST calls whose context has no deadline.
+const defaultTimeout = 30 * time.Second
+
+// call makes a REST call, in and out are JSON encoded and decoded when not nil.
+// It returns the response headers.
+func (c *Client) call(
+	ctx context.Context, method, path string, query url.Values, header http.Header, in, out interface{},
+) (http.Header, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultTimeout)
+		defer cancel()
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("api-version", APIVersion)
+
+	req, err := http.NewRequest(method, c.endpoint+path+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	auth, err := c.authorization()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("User-Agent", userAgent)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, &RequestError{StatusCode: res.StatusCode, Message: errorMessage(b)}
+	}
+	if out != nil && len(b) != 0 {
+		if err := json.Unmarshal(b, out); err != nil {
+			log.Printf("%s %s: bad response %q\n", method, path, b)
+			return nil, err
+		}
+	}
+	return res.Header, nil
+}
+
+// errorMessage extracts the message of an error response body,
+// which is nested JSON in a Message field more often than not.
+func errorMessage(b []byte) string {
+	var e struct {
+		Message string
+	}
+	if err := json.Unmarshal(b, &e); err != nil || e.Message == "" {
+		return strings.TrimSpace(string(b))
+	}
+	var inner struct {
+		Message string
+	}
+	if json.Unmarshal([]byte(e.Message), &inner) == nil && inner.Message != "" {
+		return inner.Message
+	}
+	return e.Message
+}
+
+const userAgent = "iothub-golang-sdk/dev"
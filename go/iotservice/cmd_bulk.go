@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+)
+
+func init() {
+	commands["import"] = &command{"-out <file> [-concurrency n] [-group-key key] <manifest.csv|json>", importCmd}
+	commands["export"] = &command{"[-out <file.csv|json>]", exportCmd}
+}
+
+func importCmd(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	outPtr := fs.String("out", "", "file to write connection strings or derived keys to, .csv or .json")
+	concurrencyPtr := fs.Int("concurrency", 8, "devices imported at a time")
+	groupKeyPtr := fs.String("group-key", "", "DPS enrollment group key, derive device keys instead of creating devices")
+	args, err := parseArgs(fs, args, 1, "<manifest>")
+	if err != nil {
+		return err
+	}
+	if *outPtr == "" {
+		return errorf("import: -out is needed, the output holds device keys")
+	}
+	entries, err := readManifest(args[0])
+	if err != nil {
+		return err
+	}
+
+	var results []*ImportResult
+	if *groupKeyPtr != "" {
+		results = deriveKeys(entries, *groupKeyPtr)
+	} else {
+		results = importDevices(ctx, c, entries, *concurrencyPtr)
+	}
+
+	f, err := createSecret(*outPtr)
+	if err != nil {
+		return err
+	}
+	if err := writeResults(f, *outPtr, results); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Action]++
+		if r.Error != "" {
+			log.Printf("%s: %s\n", r.DeviceID, r.Error)
+		}
+	}
+	log.Printf("%d devices: %d created, %d updated, %d unchanged, %d derived, %d failed\n",
+		len(results), counts["created"], counts["updated"], counts["unchanged"], counts["derived"], counts["failed"])
+	if counts["failed"] != 0 {
+		return errorf("import: %d devices failed", counts["failed"])
+	}
+	return nil
+}
+
+func exportCmd(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	outPtr := fs.String("out", "", "file to write the manifest to, .csv or .json, default JSON to stdout")
+	if _, err := parseArgs(fs, args, 0, "no arguments"); err != nil {
+		return err
+	}
+	entries, err := exportDevices(ctx, c)
+	if err != nil {
+		return err
+	}
+	if *outPtr == "" {
+		return writeManifest(os.Stdout, "", entries)
+	}
+	f, err := os.Create(*outPtr)
+	if err != nil {
+		return err
+	}
+	if err := writeManifest(f, *outPtr, entries); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func init() {
+	commands["c2d send"] = &command{"[-ack full] [-expiry 1h] [-prop k=v] [-wait 1m] <device> <payload>", c2dSend}
+	commands["c2d feedback"] = &command{"[-timeout 0]", c2dFeedback}
+}
+
+// propsFlag collects repeated k=v flags.
+type propsFlag map[string]string
+
+func (p propsFlag) String() string {
+	return fmt.Sprint(map[string]string(p))
+}
+
+func (p propsFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return errors.New("want key=value")
+	}
+	p[s[:i]] = s[i+1:]
+	return nil
+}
+
+// errFeedbackDone stops a feedback subscription once the awaited record came in.
+var errFeedbackDone = errors.New("feedback received")
+
+func c2dSend(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("c2d send", flag.ExitOnError)
+	idPtr := fs.String("id", "", "message ID, generated by default")
+	correlationPtr := fs.String("correlation-id", "", "correlation ID")
+	ackPtr := fs.String("ack", AckNone, "feedback wanted, none, positive, negative or full")
+	expiryPtr := fs.Duration("expiry", 0, "time to live, the hub's default when 0")
+	waitPtr := fs.Duration("wait", 0, "time to wait for feedback, needs -ack")
+	props := propsFlag{}
+	fs.Var(props, "prop", "message property key=value, repeatable")
+	args, err := parseArgs(fs, args, 2, "<device> <payload>")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	m := &C2DMessage{
+		DeviceID:      args[0],
+		MessageID:     *idPtr,
+		CorrelationID: *correlationPtr,
+		Ack:           *ackPtr,
+		Properties:    props,
+		Payload:       []byte(args[1]),
+	}
+	if *expiryPtr > 0 {
+		m.ExpiryTime = time.Now().Add(*expiryPtr)
+	}
+	if err := c.SendC2D(ctx, m); err != nil {
+		return err
+	}
+	fmt.Printf("sent %s\n", m.MessageID)
+	if *waitPtr == 0 || m.Ack == AckNone {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *waitPtr)
+	defer cancel()
+	err = c.SubscribeFeedback(ctx, func(f *Feedback) error {
+		if f.Message != m {
+			// someone else's, left for them
+			return ErrSkipFeedback
+		}
+		printFeedback(f)
+		return errFeedbackDone
+	})
+	switch {
+	case err == errFeedbackDone:
+		return nil
+	case ctx.Err() == context.DeadlineExceeded:
+		return errorf("no feedback for %s within %s", m.MessageID, *waitPtr)
+	}
+	return err
+}
+
+func c2dFeedback(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("c2d feedback", flag.ExitOnError)
+	timeoutPtr := fs.Duration("timeout", 0, "stop after this long, 0 runs until interrupted")
+	if _, err := parseArgs(fs, args, 0, "no arguments"); err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if *timeoutPtr > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeoutPtr)
+		defer cancel()
+	}
+	err := c.SubscribeFeedback(ctx, func(f *Feedback) error {
+		printFeedback(f)
+		return nil
+	})
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil
+	}
+	return err
+}
+
+func printFeedback(f *Feedback) {
+	fmt.Printf("%s %s %s %s %s\n",
+		f.EnqueuedTime.Format(time.RFC3339), f.DeviceID, f.OriginalMessageID, f.StatusCode, f.Description)
+}
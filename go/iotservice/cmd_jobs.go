@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func init() {
+	commands["job method"] = &command{"-where <condition> [-start +10m] [-max-exec 1h] [-payload json] [-wait] <method>", jobMethod}
+	commands["job twin"] = &command{"-where <condition> [-start +10m] [-desired json] [-tags json] [-wait]", jobTwin}
+	commands["job get"] = &command{"<job>", jobGet}
+	commands["job cancel"] = &command{"<job>", jobCancel}
+	commands["job list"] = &command{"[-type t] [-status s]", jobList}
+	commands["job devices"] = &command{"<job>", jobDevices}
+}
+
+// jobFlags are the flags shared by the job scheduling commands.
+type jobFlags struct {
+	id       *string
+	where    *string
+	start    *string
+	maxExec  *time.Duration
+	wait     *bool
+	interval *time.Duration
+}
+
+func addJobFlags(fs *flag.FlagSet) *jobFlags {
+	return &jobFlags{
+		id:       fs.String("id", "", "job ID, generated by default"),
+		where:    fs.String("where", "", "query condition of the devices, e.g. \"tags.site = 'plant1'\""),
+		start:    fs.String("start", "", "start time, RFC 3339 or from now like +10m, now by default"),
+		maxExec:  fs.Duration("max-exec", time.Hour, "maximum execution time"),
+		wait:     fs.Bool("wait", false, "wait for the job to finish and report the devices"),
+		interval: fs.Duration("interval", 5*time.Second, "job status polling interval with -wait"),
+	}
+}
+
+// startTime parses the start flag.
+func (f *jobFlags) startTime() (time.Time, error) {
+	s := *f.start
+	switch {
+	case s == "":
+		return time.Now(), nil
+	case strings.HasPrefix(s, "+"):
+		d, err := time.ParseDuration(s[1:])
+		if err != nil {
+			return time.Time{}, errorf("bad start %q: %v", s, err)
+		}
+		return time.Now().Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errorf("bad start %q: %v", s, err)
+	}
+	return t, nil
+}
+
+func (f *jobFlags) check() error {
+	if *f.where == "" {
+		return errorf("job: -where is needed")
+	}
+	return nil
+}
+
+// scheduled prints the scheduled job and waits for it when asked to.
+func (f *jobFlags) scheduled(ctx context.Context, c *Client, j *Job) error {
+	fmt.Printf("job %s %s, starts %s\n", j.JobID, j.Status, formatTime(j.StartTime))
+	if !*f.wait {
+		return nil
+	}
+	j, err := c.WaitJob(ctx, j.JobID, *f.interval, printJobProgress)
+	if err != nil {
+		return err
+	}
+	if err := printDeviceJobs(ctx, c, j.JobID); err != nil {
+		return err
+	}
+	if j.Status != JobStatusCompleted {
+		return errorf("job %s %s: %s", j.JobID, j.Status, j.FailureReason)
+	}
+	return nil
+}
+
+func jobMethod(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("job method", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	mf := addMethodFlags(fs)
+	args, err := parseArgs(fs, args, 1, "<method>")
+	if err != nil {
+		return err
+	}
+	if err := jf.check(); err != nil {
+		return err
+	}
+	start, err := jf.startTime()
+	if err != nil {
+		return err
+	}
+	call, err := mf.call(args[0])
+	if err != nil {
+		return err
+	}
+	j, err := c.ScheduleMethodJob(ctx, *jf.id, *jf.where, call, start, *jf.maxExec)
+	if err != nil {
+		return err
+	}
+	return jf.scheduled(ctx, c, j)
+}
+
+func jobTwin(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("job twin", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	desiredPtr := fs.String("desired", "", "desired properties JSON to merge")
+	tagsPtr := fs.String("tags", "", "tags JSON to merge")
+	if _, err := parseArgs(fs, args, 0, "no arguments"); err != nil {
+		return err
+	}
+	if err := jf.check(); err != nil {
+		return err
+	}
+	start, err := jf.startTime()
+	if err != nil {
+		return err
+	}
+	patch := &Twin{}
+	if *desiredPtr != "" {
+		var desired map[string]interface{}
+		if err := json.Unmarshal([]byte(*desiredPtr), &desired); err != nil {
+			return errorf("bad desired properties: %v", err)
+		}
+		patch.Properties = &TwinProperties{Desired: desired}
+	}
+	if *tagsPtr != "" {
+		if err := json.Unmarshal([]byte(*tagsPtr), &patch.Tags); err != nil {
+			return errorf("bad tags: %v", err)
+		}
+	}
+	if patch.Properties == nil && patch.Tags == nil {
+		return errorf("job twin: nothing to update, use -desired or -tags")
+	}
+	j, err := c.ScheduleTwinJob(ctx, *jf.id, *jf.where, patch, start, *jf.maxExec)
+	if err != nil {
+		return err
+	}
+	return jf.scheduled(ctx, c, j)
+}
+
+func jobGet(ctx context.Context, c *Client, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("job get", flag.ExitOnError), args, 1, "<job>")
+	if err != nil {
+		return err
+	}
+	j, err := c.GetJob(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(j)
+}
+
+func jobCancel(ctx context.Context, c *Client, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("job cancel", flag.ExitOnError), args, 1, "<job>")
+	if err != nil {
+		return err
+	}
+	j, err := c.CancelJob(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("job %s %s\n", j.JobID, j.Status)
+	return nil
+}
+
+func jobList(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("job list", flag.ExitOnError)
+	typePtr := fs.String("type", "", "job type, scheduleDeviceMethod or scheduleUpdateTwin")
+	statusPtr := fs.String("status", "", "job status, e.g. running")
+	if _, err := parseArgs(fs, args, 0, "no arguments"); err != nil {
+		return err
+	}
+	jobs, err := c.ListJobs(ctx, *typePtr, *statusPtr)
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		fmt.Printf("%-32s %-20s %-10s %s\n", j.JobID, j.Type, j.Status, formatTime(j.StartTime))
+	}
+	return nil
+}
+
+func jobDevices(ctx context.Context, c *Client, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("job devices", flag.ExitOnError), args, 1, "<job>")
+	if err != nil {
+		return err
+	}
+	return printDeviceJobs(ctx, c, args[0])
+}
+
+func printJobProgress(j *Job) {
+	s := j.DeviceJobStatistics
+	if s == nil {
+		s = &JobStatistics{}
+	}
+	fmt.Printf("job %s %s: %d devices, %d succeeded, %d failed, %d running, %d pending\n",
+		j.JobID, j.Status, s.DeviceCount, s.SucceededCount, s.FailedCount, s.RunningCount, s.PendingCount)
+}
+
+func printDeviceJobs(ctx context.Context, c *Client, jobID string) error {
+	return c.DeviceJobs(ctx, jobID, func(d *DeviceJob) error {
+		var outcome string
+		switch {
+		case d.Error != nil:
+			outcome = d.Error.Code + " " + d.Error.Description
+		case d.Outcome != nil && d.Outcome.DeviceMethodResponse != nil:
+			r := d.Outcome.DeviceMethodResponse
+			outcome = fmt.Sprintf("%d %s", r.Status, r.Payload)
+		}
+		fmt.Printf("%-32s %-10s %s\n", d.DeviceID, d.Status, outcome)
+		return nil
+	})
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	commands["method call"] = &command{"[-module m] [-payload json] [-timeout 30s] <device> <method>", methodCall}
+	commands["method fanout"] = &command{"[-devices file] [-concurrency 16] [-payload json] <method> [device...]", methodFanOut}
+}
+
+// methodFlags are the flags shared by method commands.
+type methodFlags struct {
+	payload        *string
+	timeout        *time.Duration
+	connectTimeout *time.Duration
+}
+
+func addMethodFlags(fs *flag.FlagSet) *methodFlags {
+	return &methodFlags{
+		payload:        fs.String("payload", "", "JSON payload, e.g. 15 or '{\"interval\": 15}'"),
+		timeout:        fs.Duration("timeout", 30*time.Second, "time for the device to respond"),
+		connectTimeout: fs.Duration("connect-timeout", 0, "time for an offline device to connect"),
+	}
+}
+
+func (f *methodFlags) call(name string) (*MethodCall, error) {
+	call := &MethodCall{
+		MethodName:      name,
+		ResponseTimeout: *f.timeout,
+		ConnectTimeout:  *f.connectTimeout,
+	}
+	if *f.payload != "" {
+		if !json.Valid([]byte(*f.payload)) {
+			return nil, errorf("payload is not JSON: %s", *f.payload)
+		}
+		call.Payload = json.RawMessage(*f.payload)
+	}
+	return call, nil
+}
+
+func methodCall(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("method call", flag.ExitOnError)
+	mf := addMethodFlags(fs)
+	modulePtr := fs.String("module", "", "module ID, to call a module method")
+	args, err := parseArgs(fs, args, 2, "<device> <method>")
+	if err != nil {
+		return err
+	}
+	call, err := mf.call(args[1])
+	if err != nil {
+		return err
+	}
+
+	var res *MethodResult
+	if *modulePtr != "" {
+		res, err = c.CallModuleMethod(ctx, args[0], *modulePtr, call)
+	} else {
+		res, err = c.CallDeviceMethod(ctx, args[0], call)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("status: %d\n", res.Status)
+	fmt.Printf("payload: %s\n", res.Payload)
+	return nil
+}
+
+func methodFanOut(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("method fanout", flag.ExitOnError)
+	mf := addMethodFlags(fs)
+	devicesPtr := fs.String("devices", "", "file of device IDs, one per line, - for stdin")
+	concurrencyPtr := fs.Int("concurrency", 16, "devices called at a time")
+	jsonPtr := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errorf("method fanout: want <method> [device...]")
+	}
+	call, err := mf.call(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	deviceIDs := fs.Args()[1:]
+	if *devicesPtr != "" {
+		ids, err := readLines(*devicesPtr)
+		if err != nil {
+			return err
+		}
+		deviceIDs = append(deviceIDs, ids...)
+	}
+	if len(deviceIDs) == 0 {
+		return errorf("method fanout: no devices")
+	}
+
+	results, sum := c.CallDeviceMethods(ctx, deviceIDs, call, *concurrencyPtr)
+	if *jsonPtr {
+		return printJSON(struct {
+			Results []*FanOutResult `json:"results"`
+			Summary *FanOutSummary  `json:"summary"`
+		}{results, sum})
+	}
+	for _, r := range results {
+		if r.Result == nil {
+			fmt.Printf("%-32s failed %s\n", r.DeviceID, r.Error)
+		} else {
+			fmt.Printf("%-32s %d %s\n", r.DeviceID, r.Result.Status, r.Result.Payload)
+		}
+	}
+	fmt.Printf("\n%d devices, %d failed", sum.Devices, sum.Failed)
+	for _, code := range sum.statuses() {
+		fmt.Printf(", %d status %d", sum.Statuses[code], code)
+	}
+	fmt.Println()
+	return nil
+}
+
+// readLines reads the non-empty lines of a file, or stdin for -.
+func readLines(name string) ([]string, error) {
+	f := os.Stdin
+	if name != "-" {
+		var err error
+		if f, err = os.Open(name); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, s.Err()
+}
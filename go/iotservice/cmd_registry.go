@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+)
+
+func init() {
+	commands["device create"] = &command{"[-auth sas|selfSigned|certificateAuthority|none] [-edge] <device>", deviceCreate}
+	commands["device get"] = &command{"<device>", deviceGet}
+	commands["device update"] = &command{"[-status enabled|disabled] [-reason] [-auth] <device>", deviceUpdate}
+	commands["device list"] = &command{"[-top n]", deviceList}
+	commands["device delete"] = &command{"[-etag] <device>", deviceDelete}
+	commands["device regenerate-key"] = &command{"[-key primary|secondary|swap] <device>", deviceRegenerateKey}
+	commands["device connection-string"] = &command{"<device>", deviceConnectionString}
+	commands["module create"] = &command{"[-auth sas|selfSigned|certificateAuthority|none] <device> <module>", moduleCreate}
+	commands["module get"] = &command{"<device> <module>", moduleGet}
+	commands["module update"] = &command{"[-managed-by] [-auth] <device> <module>", moduleUpdate}
+	commands["module list"] = &command{"<device>", moduleList}
+	commands["module delete"] = &command{"[-etag] <device> <module>", moduleDelete}
+	commands["module regenerate-key"] = &command{"[-key primary|secondary|swap] <device> <module>", moduleRegenerateKey}
+	commands["module connection-string"] = &command{"<device> <module>", moduleConnectionString}
+}
+
+// authFlags are the authentication flags of create and update commands.
+type authFlags struct {
+	typ       *string
+	primary   *string
+	secondary *string
+}
+
+func addAuthFlags(fs *flag.FlagSet) *authFlags {
+	return &authFlags{
+		typ:       fs.String("auth", "", "authentication type, sas, selfSigned (x509), certificateAuthority (ca) or none"),
+		primary:   fs.String("primary-thumbprint", "", "primary X.509 thumbprint for selfSigned"),
+		secondary: fs.String("secondary-thumbprint", "", "secondary X.509 thumbprint for selfSigned"),
+	}
+}
+
+// authentication returns the chosen authentication, nil when no type was given.
+func (f *authFlags) authentication() (*Authentication, error) {
+	if *f.typ == "" && *f.primary == "" {
+		return nil, nil
+	}
+	return newAuthentication(*f.typ, *f.primary, *f.secondary)
+}
+
+func deviceCreate(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("device create", flag.ExitOnError)
+	auth := addAuthFlags(fs)
+	statusPtr := fs.String("status", StatusEnabled, "enabled or disabled")
+	edgePtr := fs.Bool("edge", false, "IoT Edge device")
+	args, err := parseArgs(fs, args, 1, "<device>")
+	if err != nil {
+		return err
+	}
+	a, err := auth.authentication()
+	if err != nil {
+		return err
+	}
+	d := &Device{DeviceID: args[0], Status: *statusPtr, Authentication: a}
+	if *edgePtr {
+		d.Capabilities = map[string]interface{}{"iotEdge": true}
+	}
+	if d, err = c.CreateDevice(ctx, d); err != nil {
+		return err
+	}
+	return printJSON(d)
+}
+
+func deviceGet(ctx context.Context, c *Client, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("device get", flag.ExitOnError), args, 1, "<device>")
+	if err != nil {
+		return err
+	}
+	d, err := c.GetDevice(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return printJSON(d)
+}
+
+func deviceUpdate(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("device update", flag.ExitOnError)
+	auth := addAuthFlags(fs)
+	statusPtr := fs.String("status", "", "enabled or disabled")
+	reasonPtr := fs.String("reason", "", "status reason")
+	args, err := parseArgs(fs, args, 1, "<device>")
+	if err != nil {
+		return err
+	}
+	d, err := c.GetDevice(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	switch *statusPtr {
+	case "":
+	case StatusEnabled, StatusDisabled:
+		d.Status = *statusPtr
+	default:
+		return errorf("unknown status %q", *statusPtr)
+	}
+	if *reasonPtr != "" {
+		d.StatusReason = *reasonPtr
+	}
+	a, err := auth.authentication()
+	if err != nil {
+		return err
+	}
+	if a != nil {
+		d.Authentication = a
+	}
+	if d, err = c.UpdateDevice(ctx, d); err != nil {
+		return err
+	}
+	return printJSON(d)
+}
+
+func deviceList(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("device list", flag.ExitOnError)
+	topPtr := fs.Int("top", 1000, "maximum number of devices")
+	if _, err := parseArgs(fs, args, 0, "no arguments"); err != nil {
+		return err
+	}
+	devices, err := c.ListDevices(ctx, *topPtr)
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		fmt.Printf("%-32s %-9s %-12s %s\n", d.DeviceID, d.Status, d.ConnectionState, authType(d.Authentication))
+	}
+	return nil
+}
+
+func deviceDelete(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("device delete", flag.ExitOnError)
+	etagPtr := fs.String("etag", "", "only delete this version of the device")
+	args, err := parseArgs(fs, args, 1, "<device>")
+	if err != nil {
+		return err
+	}
+	return c.DeleteDevice(ctx, args[0], *etagPtr)
+}
+
+func deviceRegenerateKey(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("device regenerate-key", flag.ExitOnError)
+	keyPtr := fs.String("key", KeyPrimary, "primary, secondary or swap")
+	args, err := parseArgs(fs, args, 1, "<device>")
+	if err != nil {
+		return err
+	}
+	d, err := c.RegenerateDeviceKey(ctx, args[0], *keyPtr)
+	if err != nil {
+		return err
+	}
+	return printJSON(d.Authentication)
+}
+
+func deviceConnectionString(ctx context.Context, c *Client, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("device connection-string", flag.ExitOnError), args, 1, "<device>")
+	if err != nil {
+		return err
+	}
+	d, err := c.GetDevice(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println(d.ConnectionString(c.HostName()))
+	return nil
+}
+
+func moduleCreate(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("module create", flag.ExitOnError)
+	auth := addAuthFlags(fs)
+	managedByPtr := fs.String("managed-by", "", "who manages the module, e.g. iotEdge")
+	args, err := parseArgs(fs, args, 2, "<device> <module>")
+	if err != nil {
+		return err
+	}
+	a, err := auth.authentication()
+	if err != nil {
+		return err
+	}
+	m := &Module{DeviceID: args[0], ModuleID: args[1], ManagedBy: *managedByPtr, Authentication: a}
+	if m, err = c.CreateModule(ctx, m); err != nil {
+		return err
+	}
+	return printJSON(m)
+}
+
+func moduleGet(ctx context.Context, c *Client, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("module get", flag.ExitOnError), args, 2, "<device> <module>")
+	if err != nil {
+		return err
+	}
+	m, err := c.GetModule(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return printJSON(m)
+}
+
+func moduleUpdate(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("module update", flag.ExitOnError)
+	auth := addAuthFlags(fs)
+	managedByPtr := fs.String("managed-by", "", "who manages the module, e.g. iotEdge")
+	args, err := parseArgs(fs, args, 2, "<device> <module>")
+	if err != nil {
+		return err
+	}
+	m, err := c.GetModule(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	if *managedByPtr != "" {
+		m.ManagedBy = *managedByPtr
+	}
+	a, err := auth.authentication()
+	if err != nil {
+		return err
+	}
+	if a != nil {
+		m.Authentication = a
+	}
+	if m, err = c.UpdateModule(ctx, m); err != nil {
+		return err
+	}
+	return printJSON(m)
+}
+
+func moduleList(ctx context.Context, c *Client, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("module list", flag.ExitOnError), args, 1, "<device>")
+	if err != nil {
+		return err
+	}
+	modules, err := c.ListModules(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	for _, m := range modules {
+		fmt.Printf("%-32s %-12s %s\n", m.ModuleID, m.ConnectionState, authType(m.Authentication))
+	}
+	return nil
+}
+
+func moduleDelete(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("module delete", flag.ExitOnError)
+	etagPtr := fs.String("etag", "", "only delete this version of the module")
+	args, err := parseArgs(fs, args, 2, "<device> <module>")
+	if err != nil {
+		return err
+	}
+	return c.DeleteModule(ctx, args[0], args[1], *etagPtr)
+}
+
+func moduleRegenerateKey(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("module regenerate-key", flag.ExitOnError)
+	keyPtr := fs.String("key", KeyPrimary, "primary, secondary or swap")
+	args, err := parseArgs(fs, args, 2, "<device> <module>")
+	if err != nil {
+		return err
+	}
+	m, err := c.RegenerateModuleKey(ctx, args[0], args[1], *keyPtr)
+	if err != nil {
+		return err
+	}
+	return printJSON(m.Authentication)
+}
+
+func moduleConnectionString(ctx context.Context, c *Client, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("module connection-string", flag.ExitOnError), args, 2, "<device> <module>")
+	if err != nil {
+		return err
+	}
+	m, err := c.GetModule(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Println(m.ConnectionString(c.HostName()))
+	return nil
+}
+
+func authType(a *Authentication) string {
+	if a == nil {
+		return ""
+	}
+	return a.Type
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+func init() {
+	commands["twin get"] = &command{"[-module m] <device>", twinGet}
+	commands["twin replace"] = &command{"[-module m] [-etag e] <device> <twin.json|->", twinReplace}
+	commands["twin update"] = &command{"[-module m] [-etag e] [-desired json] [-tags json] <device>", twinUpdate}
+	commands["query"] = &command{"[-page-size 100] [-max n] <query>", queryCmd}
+}
+
+// errQueryMax stops a query once enough results were printed.
+var errQueryMax = errors.New("query: max results")
+
+func twinGet(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("twin get", flag.ExitOnError)
+	modulePtr := fs.String("module", "", "module ID, for a module twin")
+	args, err := parseArgs(fs, args, 1, "<device>")
+	if err != nil {
+		return err
+	}
+	var t *Twin
+	if *modulePtr != "" {
+		t, err = c.GetModuleTwin(ctx, args[0], *modulePtr)
+	} else {
+		t, err = c.GetTwin(ctx, args[0])
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(t)
+}
+
+func twinReplace(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("twin replace", flag.ExitOnError)
+	modulePtr := fs.String("module", "", "module ID, for a module twin")
+	etagPtr := fs.String("etag", "", "only replace this version of the twin, overrides the file's etag")
+	args, err := parseArgs(fs, args, 2, "<device> <twin.json|->")
+	if err != nil {
+		return err
+	}
+	var b []byte
+	if args[1] == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(args[1])
+	}
+	if err != nil {
+		return err
+	}
+	var t Twin
+	if err := json.Unmarshal(b, &t); err != nil {
+		return err
+	}
+	if *etagPtr != "" {
+		t.ETag = *etagPtr
+	}
+
+	var res *Twin
+	if *modulePtr != "" {
+		res, err = c.ReplaceModuleTwin(ctx, args[0], *modulePtr, &t)
+	} else {
+		res, err = c.ReplaceTwin(ctx, args[0], &t)
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+func twinUpdate(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("twin update", flag.ExitOnError)
+	modulePtr := fs.String("module", "", "module ID, for a module twin")
+	etagPtr := fs.String("etag", "", "only update this version of the twin")
+	desiredPtr := fs.String("desired", "", "desired properties JSON to merge, null removes a property")
+	tagsPtr := fs.String("tags", "", "tags JSON to merge, null removes a tag")
+	args, err := parseArgs(fs, args, 1, "<device>")
+	if err != nil {
+		return err
+	}
+	patch := &Twin{ETag: *etagPtr}
+	if *desiredPtr != "" {
+		var desired map[string]interface{}
+		if err := json.Unmarshal([]byte(*desiredPtr), &desired); err != nil {
+			return errorf("bad desired properties: %v", err)
+		}
+		patch.Properties = &TwinProperties{Desired: desired}
+	}
+	if *tagsPtr != "" {
+		if err := json.Unmarshal([]byte(*tagsPtr), &patch.Tags); err != nil {
+			return errorf("bad tags: %v", err)
+		}
+	}
+	if patch.Properties == nil && patch.Tags == nil {
+		return errorf("twin update: nothing to update, use -desired or -tags")
+	}
+
+	var res *Twin
+	if *modulePtr != "" {
+		res, err = c.UpdateModuleTwin(ctx, args[0], *modulePtr, patch)
+	} else {
+		res, err = c.UpdateTwin(ctx, args[0], patch)
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+func queryCmd(ctx context.Context, c *Client, args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	pageSizePtr := fs.Int("page-size", 100, "results fetched at a time")
+	maxPtr := fs.Int("max", 0, "stop after this many results, 0 for all")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errorf("query: want <query>")
+	}
+
+	// one result per line, to pipe into jq and the like
+	n := 0
+	err := c.Query(ctx, strings.Join(fs.Args(), " "), *pageSizePtr, func(v map[string]interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		if n++; *maxPtr > 0 && n >= *maxPtr {
+			return errQueryMax
+		}
+		return nil
+	})
+	if err == errQueryMax {
+		return nil
+	}
+	return err
+}
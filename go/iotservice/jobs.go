@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Job types.
+const (
+	JobDeviceMethod = "scheduleDeviceMethod"
+	JobUpdateTwin   = "scheduleUpdateTwin"
+)
+
+// Job statuses.
+const (
+	JobStatusQueued    = "queued"
+	JobStatusScheduled = "scheduled"
+	JobStatusEnqueued  = "enqueued"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+)
+
+// Job is a direct method or twin update job on the devices matching a query condition.
+type Job struct {
+	JobID                     string         `json:"jobId"`
+	Type                      string         `json:"type"`
+	QueryCondition            string         `json:"queryCondition,omitempty"`
+	StartTime                 *time.Time     `json:"startTime,omitempty"`
+	MaxExecutionTimeInSeconds int            `json:"maxExecutionTimeInSeconds,omitempty"`
+	CloudToDeviceMethod       *MethodRequest `json:"cloudToDeviceMethod,omitempty"`
+	UpdateTwin                *Twin          `json:"updateTwin,omitempty"`
+
+	// set by the hub
+	CreatedTime         *time.Time     `json:"createdTime,omitempty"`
+	EndTime             *time.Time     `json:"endTime,omitempty"`
+	Status              string         `json:"status,omitempty"`
+	FailureReason       string         `json:"failureReason,omitempty"`
+	StatusMessage       string         `json:"statusMessage,omitempty"`
+	DeviceJobStatistics *JobStatistics `json:"deviceJobStatistics,omitempty"`
+}
+
+// JobStatistics counts the devices of a job by status.
+type JobStatistics struct {
+	DeviceCount    int `json:"deviceCount"`
+	FailedCount    int `json:"failedCount"`
+	SucceededCount int `json:"succeededCount"`
+	RunningCount   int `json:"runningCount"`
+	PendingCount   int `json:"pendingCount"`
+}
+
+// Done reports whether the job has finished, one way or another.
+func (j *Job) Done() bool {
+	switch j.Status {
+	case JobStatusCompleted, JobStatusFailed, JobStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// DeviceJob is the outcome of a job on one device.
+type DeviceJob struct {
+	DeviceID      string     `json:"deviceId"`
+	ModuleID      string     `json:"moduleId,omitempty"`
+	JobID         string     `json:"jobId"`
+	JobType       string     `json:"jobType"`
+	Status        string     `json:"status"`
+	StartTimeUTC  *time.Time `json:"startTimeUtc,omitempty"`
+	EndTimeUTC    *time.Time `json:"endTimeUtc,omitempty"`
+	LastUpdatedAt *time.Time `json:"lastUpdatedDateTimeUtc,omitempty"`
+	Outcome       *struct {
+		DeviceMethodResponse *MethodResult `json:"deviceMethodResponse,omitempty"`
+	} `json:"outcome,omitempty"`
+	Error *struct {
+		Code        string `json:"code"`
+		Description string `json:"description"`
+	} `json:"error,omitempty"`
+}
+
+func jobPath(jobID string) string {
+	return "/jobs/v2/" + url.PathEscape(jobID)
+}
+
+// ScheduleMethodJob schedules a direct method call on the devices matching
+// the query condition, e.g. "tags.site = 'plant1'", at start for at most maxExecution.
+func (c *Client) ScheduleMethodJob(
+	ctx context.Context, jobID, condition string, call *MethodCall, start time.Time, maxExecution time.Duration,
+) (*Job, error) {
+	if call.MethodName == "" {
+		return nil, errorf("method name is empty")
+	}
+	return c.scheduleJob(ctx, &Job{
+		JobID:                     jobID,
+		Type:                      JobDeviceMethod,
+		QueryCondition:            condition,
+		StartTime:                 &start,
+		MaxExecutionTimeInSeconds: int(maxExecution / time.Second),
+		CloudToDeviceMethod:       call.request(),
+	})
+}
+
+// ScheduleTwinJob schedules a twin update, the tags and desired properties of
+// the patch, on the devices matching the query condition.
+func (c *Client) ScheduleTwinJob(
+	ctx context.Context, jobID, condition string, patch *Twin, start time.Time, maxExecution time.Duration,
+) (*Job, error) {
+	p := *patch
+	if p.ETag == "" {
+		p.ETag = "*"
+	}
+	return c.scheduleJob(ctx, &Job{
+		JobID:                     jobID,
+		Type:                      JobUpdateTwin,
+		QueryCondition:            condition,
+		StartTime:                 &start,
+		MaxExecutionTimeInSeconds: int(maxExecution / time.Second),
+		UpdateTwin:                &p,
+	})
+}
+
+func (c *Client) scheduleJob(ctx context.Context, j *Job) (*Job, error) {
+	if j.JobID == "" {
+		j.JobID = genID()
+	}
+	if strings.TrimSpace(j.QueryCondition) == "" {
+		return nil, errorf("job needs a query condition")
+	}
+	var res Job
+	if _, err := c.call(ctx, http.MethodPut, jobPath(j.JobID), nil, nil, j, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// GetJob returns the job of the given ID.
+func (c *Client) GetJob(ctx context.Context, jobID string) (*Job, error) {
+	var res Job
+	if _, err := c.call(ctx, http.MethodGet, jobPath(jobID), nil, nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// CancelJob cancels a scheduled or running job.
+func (c *Client) CancelJob(ctx context.Context, jobID string) (*Job, error) {
+	var res Job
+	if _, err := c.call(ctx, http.MethodPost, jobPath(jobID)+"/cancel", nil, nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ListJobs returns the jobs of the given type and status, both optional,
+// paging through the results.
+func (c *Client) ListJobs(ctx context.Context, jobType, status string) ([]*Job, error) {
+	q := url.Values{}
+	if jobType != "" {
+		q.Set("jobType", jobType)
+	}
+	if status != "" {
+		q.Set("jobStatus", status)
+	}
+	var jobs []*Job
+	header := http.Header{}
+	for {
+		var res struct {
+			Items []*Job `json:"items"`
+		}
+		h, err := c.call(ctx, http.MethodGet, "/jobs/v2/query", q, header, nil, &res)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, res.Items...)
+		next := h.Get("x-ms-continuation")
+		if next == "" {
+			return jobs, nil
+		}
+		header.Set("x-ms-continuation", next)
+	}
+}
+
+// WaitJob polls the job every interval until it's done, calling fn, when not nil,
+// with every status read.
+func (c *Client) WaitJob(ctx context.Context, jobID string, interval time.Duration, fn func(j *Job)) (*Job, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		j, err := c.GetJob(ctx, jobID)
+		if err != nil {
+			return nil, err
+		}
+		if fn != nil {
+			fn(j)
+		}
+		if j.Done() {
+			return j, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return j, ctx.Err()
+		}
+	}
+}
+
+// DeviceJobs calls fn with the outcome of the job on every device.
+func (c *Client) DeviceJobs(ctx context.Context, jobID string, fn func(d *DeviceJob) error) error {
+	if strings.ContainsRune(jobID, '\'') {
+		return errorf("bad job ID %q", jobID)
+	}
+	q := "SELECT * FROM devices.jobs WHERE devices.jobs.jobId = '" + jobID + "'"
+	return c.Query(ctx, q, 100, func(v map[string]interface{}) error {
+		var d DeviceJob
+		if err := remarshal(v, &d); err != nil {
+			return err
+		}
+		return fn(&d)
+	})
+}
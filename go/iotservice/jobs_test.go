@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeJobs is an in-memory jobs service, listing jobs a page at a time
+// and answering device job queries.
+type fakeJobs struct {
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	pageLen int
+	devices []*DeviceJob
+}
+
+func (s *fakeJobs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/jobs/v2/query" && r.Method == http.MethodGet:
+		var ids []string
+		for id, j := range s.jobs {
+			if t := r.URL.Query().Get("jobType"); t != "" && j.Type != t {
+				continue
+			}
+			if st := r.URL.Query().Get("jobStatus"); st != "" && j.Status != st {
+				continue
+			}
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		from, _ := strconv.Atoi(r.Header.Get("x-ms-continuation"))
+		to := from + s.pageLen
+		if to < len(ids) {
+			w.Header().Set("x-ms-continuation", strconv.Itoa(to))
+		} else {
+			to = len(ids)
+		}
+		var res struct {
+			Items []*Job `json:"items"`
+		}
+		for _, id := range ids[from:to] {
+			res.Items = append(res.Items, s.jobs[id])
+		}
+		json.NewEncoder(w).Encode(&res)
+
+	case r.URL.Path == "/devices/query" && r.Method == http.MethodPost:
+		b, _ := ioutil.ReadAll(r.Body)
+		var q struct{ Query string }
+		json.Unmarshal(b, &q)
+		var res []*DeviceJob
+		for _, d := range s.devices {
+			if strings.Contains(q.Query, "'"+d.JobID+"'") {
+				res = append(res, d)
+			}
+		}
+		json.NewEncoder(w).Encode(res)
+
+	case strings.HasSuffix(r.URL.Path, "/cancel") && r.Method == http.MethodPost:
+		j, ok := s.jobs[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/jobs/v2/"), "/cancel")]
+		if !ok {
+			http.Error(w, `{"Message":"job not found"}`, http.StatusNotFound)
+			return
+		}
+		j.Status = JobStatusCancelled
+		json.NewEncoder(w).Encode(j)
+
+	case strings.HasPrefix(r.URL.Path, "/jobs/v2/"):
+		id := strings.TrimPrefix(r.URL.Path, "/jobs/v2/")
+		switch r.Method {
+		case http.MethodPut:
+			var j Job
+			if err := json.NewDecoder(r.Body).Decode(&j); err != nil || j.JobID != id {
+				http.Error(w, `{"Message":"bad job"}`, http.StatusBadRequest)
+				return
+			}
+			j.Status = JobStatusQueued
+			s.jobs[id] = &j
+			json.NewEncoder(w).Encode(&j)
+		case http.MethodGet:
+			j, ok := s.jobs[id]
+			if !ok {
+				http.Error(w, `{"Message":"job not found"}`, http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(j)
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	s := &fakeJobs{jobs: map[string]*Job{}, pageLen: 2}
+	c := newTestClient(t, s)
+	ctx := context.Background()
+	start := time.Now().Add(10 * time.Minute).UTC().Truncate(time.Second)
+
+	j, err := c.ScheduleMethodJob(ctx, "reboot-1", "tags.site = 'plant1'",
+		&MethodCall{MethodName: "reboot", Payload: json.RawMessage(`{"delay":10}`)}, start, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Type != JobDeviceMethod || j.Status != JobStatusQueued || j.CloudToDeviceMethod.MethodName != "reboot" ||
+		j.MaxExecutionTimeInSeconds != 3600 || !j.StartTime.Equal(start) {
+		t.Fatalf("ScheduleMethodJob = %+v", j)
+	}
+	if _, err := c.ScheduleMethodJob(ctx, "", " ", &MethodCall{MethodName: "reboot"}, start, time.Hour); err == nil {
+		t.Fatal("ScheduleMethodJob without a condition: want an error")
+	}
+
+	for _, id := range []string{"twin-1", "twin-2", "twin-3"} {
+		j, err := c.ScheduleTwinJob(ctx, id, "tags.site = 'plant1'",
+			&Twin{Tags: map[string]interface{}{"fw": "1.2"}}, start, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.Type != JobUpdateTwin || j.UpdateTwin.ETag != "*" || j.UpdateTwin.Tags["fw"] != "1.2" {
+			t.Fatalf("ScheduleTwinJob = %+v", j)
+		}
+	}
+
+	got, err := c.GetJob(ctx, "reboot-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.JobID != "reboot-1" || got.QueryCondition != "tags.site = 'plant1'" {
+		t.Fatalf("GetJob = %+v", got)
+	}
+	if _, err := c.GetJob(ctx, "nope"); !isStatus(err, http.StatusNotFound) {
+		t.Fatalf("GetJob of a missing job: err = %v, want 404", err)
+	}
+
+	cancelled, err := c.CancelJob(ctx, "twin-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled.Status != JobStatusCancelled || !cancelled.Done() {
+		t.Fatalf("CancelJob = %+v, want cancelled", cancelled)
+	}
+
+	// four jobs on two pages
+	all, err := c.ListJobs(ctx, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 4 {
+		t.Fatalf("ListJobs = %d jobs, want 4 over two pages", len(all))
+	}
+	twins, err := c.ListJobs(ctx, JobUpdateTwin, JobStatusQueued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(twins) != 2 || twins[0].JobID != "twin-1" || twins[1].JobID != "twin-3" {
+		t.Fatalf("ListJobs(twin, queued) = %v, want twin-1 and twin-3", twins)
+	}
+
+	s.devices = []*DeviceJob{
+		{DeviceID: "beagle-1", JobID: "reboot-1", JobType: JobDeviceMethod, Status: JobStatusCompleted},
+		{DeviceID: "beagle-2", JobID: "reboot-1", JobType: JobDeviceMethod, Status: JobStatusFailed},
+		{DeviceID: "beagle-1", JobID: "twin-1", JobType: JobUpdateTwin, Status: JobStatusCompleted},
+	}
+	var outcomes []string
+	if err := c.DeviceJobs(ctx, "reboot-1", func(d *DeviceJob) error {
+		outcomes = append(outcomes, d.DeviceID+"="+d.Status)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(outcomes, " ") != "beagle-1=completed beagle-2=failed" {
+		t.Fatalf("DeviceJobs = %v", outcomes)
+	}
+	if err := c.DeviceJobs(ctx, "x' OR '1'='1", func(d *DeviceJob) error { return nil }); err == nil {
+		t.Fatal("DeviceJobs with a quote in the job ID: want an error")
+	}
+}
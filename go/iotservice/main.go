@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+const usage = `Usage: iotservice [-cs <service connection string>] <command> [flags] [args]
+
+The connection string defaults to $IOTHUB_SERVICE_CONNECTION_STRING, e.g.
+HostName=seb-hub.azure-devices.net;SharedAccessKeyName=registryReadWrite;SharedAccessKey=...
+
+Flags go before the arguments of a command.
+
+Commands:
+`
+
+// command is a subcommand of iotservice.
+type command struct {
+	usage string
+	run   func(ctx context.Context, c *Client, args []string) error
+}
+
+var commands = map[string]*command{}
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = printUsage
+	csPtr := flag.String("cs", os.Getenv("IOTHUB_SERVICE_CONNECTION_STRING"), "service connection string")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	// subcommands are named by one or two words, e.g. "device create"
+	args := flag.Args()
+	cmd, ok := commands[args[0]]
+	if ok {
+		args = args[1:]
+	} else if len(args) > 1 {
+		cmd, ok = commands[args[0]+" "+args[1]]
+		args = args[2:]
+	}
+	if !ok {
+		fmt.Fprintf(os.Stderr, "iotservice: unknown command %q\n\n", strings.Join(flag.Args(), " "))
+		printUsage()
+		os.Exit(2)
+	}
+
+	if *csPtr == "" {
+		log.Fatal("iotservice: no connection string, set -cs or $IOTHUB_SERVICE_CONNECTION_STRING")
+	}
+	c, err := NewClient(*csPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cmd.run(context.Background(), c, args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func printUsage() {
+	fmt.Fprint(os.Stderr, usage)
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-28s %s\n", name, commands[name].usage)
+	}
+}
+
+// printJSON prints v as indented JSON.
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// parseArgs parses the flags of a command and checks it has n arguments.
+func parseArgs(fs *flag.FlagSet, args []string, n int, names string) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != n {
+		return nil, errorf("%s: want %s", fs.Name(), names)
+	}
+	return fs.Args(), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// MethodCall is a direct method invocation.
+type MethodCall struct {
+	MethodName      string
+	Payload         json.RawMessage // JSON, null when empty
+	ResponseTimeout time.Duration   // 30s when zero
+	ConnectTimeout  time.Duration   // devices must be connected already when zero
+}
+
+// MethodRequest is the wire form of a method call, as sent on its own or in jobs.
+type MethodRequest struct {
+	MethodName               string          `json:"methodName"`
+	Payload                  json.RawMessage `json:"payload,omitempty"`
+	ResponseTimeoutInSeconds int             `json:"responseTimeoutInSeconds"`
+	ConnectTimeoutInSeconds  int             `json:"connectTimeoutInSeconds"`
+}
+
+// request returns the wire form of the call, with the default response timeout.
+func (call *MethodCall) request() *MethodRequest {
+	responseTimeout := call.ResponseTimeout
+	if responseTimeout == 0 {
+		responseTimeout = 30 * time.Second
+	}
+	return &MethodRequest{
+		MethodName:               call.MethodName,
+		Payload:                  call.Payload,
+		ResponseTimeoutInSeconds: int(responseTimeout / time.Second),
+		ConnectTimeoutInSeconds:  int(call.ConnectTimeout / time.Second),
+	}
+}
+
+// MethodResult is the response of a device to a direct method.
+type MethodResult struct {
+	Status  int             `json:"status"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// CallDeviceMethod invokes a direct method on a device and returns its response.
+func (c *Client) CallDeviceMethod(ctx context.Context, deviceID string, call *MethodCall) (*MethodResult, error) {
+	return c.callMethod(ctx, twinPath(deviceID)+"/methods", call)
+}
+
+// CallModuleMethod invokes a direct method on a module.
+func (c *Client) CallModuleMethod(ctx context.Context, deviceID, moduleID string, call *MethodCall) (*MethodResult, error) {
+	return c.callMethod(ctx, twinPath(deviceID)+"/modules/"+url.PathEscape(moduleID)+"/methods", call)
+}
+
+func (c *Client) callMethod(ctx context.Context, path string, call *MethodCall) (*MethodResult, error) {
+	if call.MethodName == "" {
+		return nil, errorf("method name is empty")
+	}
+	req := call.request()
+
+	// the hub answers within both timeouts, give the HTTP round trip some more
+	timeout := time.Duration(req.ResponseTimeoutInSeconds+req.ConnectTimeoutInSeconds)*time.Second + 10*time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var res MethodResult
+	if _, err := c.call(ctx, http.MethodPost, path, nil, nil, req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// FanOutResult is the outcome of a method call on one of many devices.
+type FanOutResult struct {
+	DeviceID string        `json:"deviceId"`
+	Result   *MethodResult `json:"result,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// FanOutSummary counts the outcomes of a fan-out call.
+type FanOutSummary struct {
+	Devices  int         `json:"devices"`
+	Statuses map[int]int `json:"statuses"` // device response status -> count
+	Failed   int         `json:"failed"`   // no response, e.g. offline or timed out
+}
+
+// CallDeviceMethods invokes the method on all devices, at most concurrency at a time.
+// Results are in the order of the devices.
+func (c *Client) CallDeviceMethods(
+	ctx context.Context, deviceIDs []string, call *MethodCall, concurrency int,
+) ([]*FanOutResult, *FanOutSummary) {
+	results := make([]*FanOutResult, len(deviceIDs))
+	forEach(len(deviceIDs), concurrency, func(i int) {
+		start := time.Now()
+		res, err := c.CallDeviceMethod(ctx, deviceIDs[i], call)
+		r := &FanOutResult{DeviceID: deviceIDs[i], Result: res, Duration: time.Since(start)}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		results[i] = r
+	})
+
+	sum := &FanOutSummary{Devices: len(results), Statuses: map[int]int{}}
+	for _, r := range results {
+		if r.Result == nil {
+			sum.Failed++
+		} else {
+			sum.Statuses[r.Result.Status]++
+		}
+	}
+	return results, sum
+}
+
+// statuses returns the response statuses of the summary in order.
+func (s *FanOutSummary) statuses() []int {
+	codes := make([]int, 0, len(s.Statuses))
+	for code := range s.Statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	return codes
+}
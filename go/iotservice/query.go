@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// QueryPage runs an IoT Hub query language query, e.g.
+// SELECT * FROM devices WHERE tags.site = 'plant1', and returns a page of
+// at most pageSize results, 100 by default, and the continuation token
+// of the next page, empty on the last page.
+func (c *Client) QueryPage(
+	ctx context.Context, query string, pageSize int, continuation string,
+) ([]map[string]interface{}, string, error) {
+	header := http.Header{}
+	if pageSize > 0 {
+		header.Set("x-ms-max-item-count", strconv.Itoa(pageSize))
+	}
+	if continuation != "" {
+		header.Set("x-ms-continuation", continuation)
+	}
+	var res []map[string]interface{}
+	h, err := c.call(ctx, http.MethodPost, "/devices/query", nil, header,
+		map[string]string{"query": query}, &res)
+	if err != nil {
+		return nil, "", err
+	}
+	return res, h.Get("x-ms-continuation"), nil
+}
+
+// Query runs a query calling fn for every result, fetching pages of pageSize
+// as needed, until the results run out or fn returns an error.
+func (c *Client) Query(
+	ctx context.Context, query string, pageSize int, fn func(v map[string]interface{}) error,
+) error {
+	var continuation string
+	for {
+		page, next, err := c.QueryPage(ctx, query, pageSize, continuation)
+		if err != nil {
+			return err
+		}
+		for _, v := range page {
+			if err := fn(v); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		continuation = next
+	}
+}
+
+// QueryTwins runs a query selecting whole twins, e.g.
+// SELECT * FROM devices.modules WHERE moduleId = 'GoMqttPubModule'.
+func (c *Client) QueryTwins(ctx context.Context, query string, pageSize int, fn func(t *Twin) error) error {
+	return c.Query(ctx, query, pageSize, func(v map[string]interface{}) error {
+		var t Twin
+		if err := remarshal(v, &t); err != nil {
+			return err
+		}
+		return fn(&t)
+	})
+}
+
+// remarshal converts a query result into the given type.
+func remarshal(v map[string]interface{}, out interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Authentication types.
+const (
+	AuthSAS                  = "sas"
+	AuthSelfSigned           = "selfSigned"
+	AuthCertificateAuthority = "certificateAuthority"
+	AuthNone                 = "none"
+)
+
+// Device and module status.
+const (
+	StatusEnabled  = "enabled"
+	StatusDisabled = "disabled"
+)
+
+// Device is a device identity in the registry.
+type Device struct {
+	DeviceID                   string                 `json:"deviceId"`
+	GenerationID               string                 `json:"generationId,omitempty"`
+	ETag                       string                 `json:"etag,omitempty"`
+	ConnectionState            string                 `json:"connectionState,omitempty"`
+	Status                     string                 `json:"status,omitempty"`
+	StatusReason               string                 `json:"statusReason,omitempty"`
+	ConnectionStateUpdatedTime *time.Time             `json:"connectionStateUpdatedTime,omitempty"`
+	StatusUpdatedTime          *time.Time             `json:"statusUpdatedTime,omitempty"`
+	LastActivityTime           *time.Time             `json:"lastActivityTime,omitempty"`
+	CloudToDeviceMessageCount  int                    `json:"cloudToDeviceMessageCount,omitempty"`
+	Authentication             *Authentication        `json:"authentication,omitempty"`
+	Capabilities               map[string]interface{} `json:"capabilities,omitempty"`
+}
+
+// Module is a module identity of a device.
+type Module struct {
+	ModuleID                   string          `json:"moduleId"`
+	DeviceID                   string          `json:"deviceId"`
+	GenerationID               string          `json:"generationId,omitempty"`
+	ETag                       string          `json:"etag,omitempty"`
+	ConnectionState            string          `json:"connectionState,omitempty"`
+	ConnectionStateUpdatedTime *time.Time      `json:"connectionStateUpdatedTime,omitempty"`
+	LastActivityTime           *time.Time      `json:"lastActivityTime,omitempty"`
+	CloudToDeviceMessageCount  int             `json:"cloudToDeviceMessageCount,omitempty"`
+	ManagedBy                  string          `json:"managedBy,omitempty"`
+	Authentication             *Authentication `json:"authentication,omitempty"`
+}
+
+// Authentication is the authentication mechanism of a device or module.
+type Authentication struct {
+	SymmetricKey   *SymmetricKey   `json:"symmetricKey,omitempty"`
+	X509Thumbprint *X509Thumbprint `json:"x509Thumbprint,omitempty"`
+	Type           string          `json:"type,omitempty"`
+}
+
+// SymmetricKey is a pair of base64 shared access keys.
+type SymmetricKey struct {
+	PrimaryKey   string `json:"primaryKey"`
+	SecondaryKey string `json:"secondaryKey"`
+}
+
+// X509Thumbprint is a pair of certificate thumbprints.
+type X509Thumbprint struct {
+	PrimaryThumbprint   string `json:"primaryThumbprint,omitempty"`
+	SecondaryThumbprint string `json:"secondaryThumbprint,omitempty"`
+}
+
+// Key selects the key or thumbprint regenerated or used.
+const (
+	KeyPrimary   = "primary"
+	KeySecondary = "secondary"
+	KeySwap      = "swap" // swap the primary and secondary keys
+)
+
+// ifMatch makes updates conditional on the etag, "*" overwrites unconditionally.
+func ifMatch(etag string) http.Header {
+	if etag == "" {
+		etag = "*"
+	} else {
+		etag = strconv.Quote(etag)
+	}
+	return http.Header{"If-Match": []string{etag}}
+}
+
+func devicePath(deviceID string) string {
+	return "/devices/" + url.PathEscape(deviceID)
+}
+
+func modulePath(deviceID, moduleID string) string {
+	return devicePath(deviceID) + "/modules/" + url.PathEscape(moduleID)
+}
+
+// CreateDevice creates a device, IoT Hub generates SAS keys when none are given.
+func (c *Client) CreateDevice(ctx context.Context, d *Device) (*Device, error) {
+	var res Device
+	if _, err := c.call(ctx, http.MethodPut, devicePath(d.DeviceID), nil, nil, d, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// GetDevice returns the named device.
+func (c *Client) GetDevice(ctx context.Context, deviceID string) (*Device, error) {
+	var res Device
+	if _, err := c.call(ctx, http.MethodGet, devicePath(deviceID), nil, nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// UpdateDevice replaces a device, failing if it changed since d.ETag was read.
+func (c *Client) UpdateDevice(ctx context.Context, d *Device) (*Device, error) {
+	var res Device
+	if _, err := c.call(ctx, http.MethodPut, devicePath(d.DeviceID), nil, ifMatch(d.ETag), d, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ListDevices returns up to max devices of the registry, max is capped at 1000 by IoT Hub.
+func (c *Client) ListDevices(ctx context.Context, max int) ([]*Device, error) {
+	q := url.Values{}
+	if max > 0 {
+		q.Set("top", strconv.Itoa(max))
+	}
+	var res []*Device
+	if _, err := c.call(ctx, http.MethodGet, "/devices", q, nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DeleteDevice deletes a device, unconditionally when etag is empty.
+func (c *Client) DeleteDevice(ctx context.Context, deviceID, etag string) error {
+	_, err := c.call(ctx, http.MethodDelete, devicePath(deviceID), nil, ifMatch(etag), nil, nil)
+	return err
+}
+
+// CreateModule creates a module identity.
+func (c *Client) CreateModule(ctx context.Context, m *Module) (*Module, error) {
+	var res Module
+	if _, err := c.call(ctx, http.MethodPut, modulePath(m.DeviceID, m.ModuleID), nil, nil, m, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// GetModule returns the named module.
+func (c *Client) GetModule(ctx context.Context, deviceID, moduleID string) (*Module, error) {
+	var res Module
+	if _, err := c.call(ctx, http.MethodGet, modulePath(deviceID, moduleID), nil, nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// UpdateModule replaces a module, failing if it changed since m.ETag was read.
+func (c *Client) UpdateModule(ctx context.Context, m *Module) (*Module, error) {
+	var res Module
+	if _, err := c.call(ctx, http.MethodPut, modulePath(m.DeviceID, m.ModuleID), nil, ifMatch(m.ETag), m, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ListModules returns the modules of a device.
+func (c *Client) ListModules(ctx context.Context, deviceID string) ([]*Module, error) {
+	var res []*Module
+	if _, err := c.call(ctx, http.MethodGet, devicePath(deviceID)+"/modules", nil, nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DeleteModule deletes a module, unconditionally when etag is empty.
+func (c *Client) DeleteModule(ctx context.Context, deviceID, moduleID, etag string) error {
+	_, err := c.call(ctx, http.MethodDelete, modulePath(deviceID, moduleID), nil, ifMatch(etag), nil, nil)
+	return err
+}
+
+// RegenerateDeviceKey replaces the primary or secondary SAS key of a device
+// with a new random key, or swaps them. IoT Hub has no call for this,
+// the device is updated with the new keys.
+func (c *Client) RegenerateDeviceKey(ctx context.Context, deviceID, which string) (*Device, error) {
+	d, err := c.GetDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if err := regenerateKey(d.Authentication, which); err != nil {
+		return nil, err
+	}
+	return c.UpdateDevice(ctx, d)
+}
+
+// RegenerateModuleKey is RegenerateDeviceKey for modules.
+func (c *Client) RegenerateModuleKey(ctx context.Context, deviceID, moduleID, which string) (*Module, error) {
+	m, err := c.GetModule(ctx, deviceID, moduleID)
+	if err != nil {
+		return nil, err
+	}
+	if err := regenerateKey(m.Authentication, which); err != nil {
+		return nil, err
+	}
+	return c.UpdateModule(ctx, m)
+}
+
+func regenerateKey(a *Authentication, which string) error {
+	if a == nil || a.Type != AuthSAS || a.SymmetricKey == nil {
+		return errorf("only sas keys can be regenerated")
+	}
+	k := a.SymmetricKey
+	switch which {
+	case KeyPrimary:
+		key, err := newKey()
+		if err != nil {
+			return err
+		}
+		k.PrimaryKey = key
+	case KeySecondary:
+		key, err := newKey()
+		if err != nil {
+			return err
+		}
+		k.SecondaryKey = key
+	case KeySwap:
+		k.PrimaryKey, k.SecondaryKey = k.SecondaryKey, k.PrimaryKey
+	default:
+		return errorf("unknown key %q, want primary, secondary or swap", which)
+	}
+	return nil
+}
+
+// newKey returns a random 256-bit base64 key.
+func newKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// ConnectionString returns the connection string of the device with its primary key.
+func (d *Device) ConnectionString(hostName string) string {
+	return connectionString(hostName, d.DeviceID, "", d.Authentication)
+}
+
+// ConnectionString returns the connection string of the module with its primary key.
+func (m *Module) ConnectionString(hostName string) string {
+	return connectionString(hostName, m.DeviceID, m.ModuleID, m.Authentication)
+}
+
+func connectionString(hostName, deviceID, moduleID string, a *Authentication) string {
+	cs := "HostName=" + hostName + ";DeviceId=" + deviceID
+	if moduleID != "" {
+		cs += ";ModuleId=" + moduleID
+	}
+	if a != nil && a.SymmetricKey != nil {
+		return cs + ";SharedAccessKey=" + a.SymmetricKey.PrimaryKey
+	}
+	return cs + ";x509=true"
+}
+
+// newAuthentication returns the authentication of the given type, thumbprints are
+// only used with selfSigned. IoT Hub generates sas keys when none are given.
+func newAuthentication(typ, primary, secondary string) (*Authentication, error) {
+	switch typ {
+	case "", AuthSAS:
+		return &Authentication{Type: AuthSAS}, nil
+	case AuthSelfSigned, "x509":
+		if primary == "" {
+			return nil, errorf("selfSigned authentication needs a primary thumbprint")
+		}
+		return &Authentication{
+			Type: AuthSelfSigned,
+			X509Thumbprint: &X509Thumbprint{
+				PrimaryThumbprint:   primary,
+				SecondaryThumbprint: secondary,
+			},
+		}, nil
+	case AuthCertificateAuthority, "ca":
+		return &Authentication{Type: AuthCertificateAuthority}, nil
+	case AuthNone:
+		return &Authentication{Type: AuthNone}, nil
+	default:
+		return nil, errorf("unknown authentication type %q", typ)
+	}
+}
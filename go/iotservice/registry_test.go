@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testConnectionString = "HostName=test-hub.azure-devices.net;SharedAccessKeyName=service;SharedAccessKey=c2VjcmV0"
+
+// newTestClient returns a client of a local stand-in of IoT Hub serving h.
+func newTestClient(t *testing.T, h http.Handler) *Client {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	c, err := NewClient(testConnectionString, WithEndpoint(srv.URL), WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// fakeRegistry is an in-memory device registry with etags.
+type fakeRegistry struct {
+	mu      sync.Mutex
+	devices map[string]*Device
+	etag    int
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.URL.Query().Get("api-version") != APIVersion {
+		http.Error(w, `{"Message":"bad api-version"}`, http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "SharedAccessSignature ") {
+		http.Error(w, `{"Message":"unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	if req.URL.Path == "/devices" && req.Method == http.MethodGet {
+		ids := make([]string, 0, len(r.devices))
+		for id := range r.devices {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		if top, err := strconv.Atoi(req.URL.Query().Get("top")); err == nil && top < len(ids) {
+			ids = ids[:top]
+		}
+		res := make([]*Device, 0, len(ids))
+		for _, id := range ids {
+			res = append(res, r.devices[id])
+		}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, "/devices/")
+	have, ok := r.devices[id]
+	if m := req.Header.Get("If-Match"); m != "" && m != "*" && (!ok || m != strconv.Quote(have.ETag)) {
+		http.Error(w, `{"Message":"precondition failed"}`, http.StatusPreconditionFailed)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		if !ok {
+			http.Error(w, `{"Message":"device not found"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(have)
+	case http.MethodPut:
+		var d Device
+		if err := json.NewDecoder(req.Body).Decode(&d); err != nil {
+			http.Error(w, `{"Message":"bad body"}`, http.StatusBadRequest)
+			return
+		}
+		if ok && req.Header.Get("If-Match") == "" {
+			http.Error(w, `{"Message":"device already exists"}`, http.StatusConflict)
+			return
+		}
+		r.etag++
+		d.ETag = strconv.Itoa(r.etag)
+		if d.Authentication == nil {
+			d.Authentication = &Authentication{Type: AuthSAS, SymmetricKey: &SymmetricKey{"cHJpbWFyeQ==", "c2Vjb25kYXJ5"}}
+		}
+		r.devices[id] = &d
+		json.NewEncoder(w).Encode(&d)
+	case http.MethodDelete:
+		if !ok {
+			http.Error(w, `{"Message":"device not found"}`, http.StatusNotFound)
+			return
+		}
+		delete(r.devices, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	c := newTestClient(t, &fakeRegistry{devices: map[string]*Device{}})
+	ctx := context.Background()
+
+	d, err := c.CreateDevice(ctx, &Device{DeviceID: "beagle-1", Status: StatusEnabled})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ETag == "" || d.Authentication == nil || d.Authentication.SymmetricKey == nil {
+		t.Fatalf("CreateDevice = %+v, want an etag and keys", d)
+	}
+	if _, err := c.CreateDevice(ctx, &Device{DeviceID: "beagle-1"}); !isStatus(err, http.StatusConflict) {
+		t.Fatalf("CreateDevice of an existing device: err = %v, want 409", err)
+	}
+	if _, err := c.CreateDevice(ctx, &Device{DeviceID: "beagle-2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := c.GetDevice(ctx, "beagle-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ETag != d.ETag || got.Status != StatusEnabled {
+		t.Fatalf("GetDevice = %+v, want %+v", got, d)
+	}
+	if _, err := c.GetDevice(ctx, "nope"); !isStatus(err, http.StatusNotFound) {
+		t.Fatalf("GetDevice of a missing device: err = %v, want 404", err)
+	}
+
+	got.Status = StatusDisabled
+	updated, err := c.UpdateDevice(ctx, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Status != StatusDisabled || updated.ETag == got.ETag {
+		t.Fatalf("UpdateDevice = %+v, want disabled with a new etag", updated)
+	}
+	// got is stale now
+	if _, err := c.UpdateDevice(ctx, got); !isStatus(err, http.StatusPreconditionFailed) {
+		t.Fatalf("UpdateDevice with a stale etag: err = %v, want 412", err)
+	}
+	got.ETag = ""
+	if _, err := c.UpdateDevice(ctx, got); err != nil {
+		t.Fatalf("UpdateDevice without an etag: %v", err)
+	}
+
+	list, err := c.ListDevices(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].DeviceID != "beagle-1" {
+		t.Fatalf("ListDevices(1) = %v, want beagle-1", list)
+	}
+	if list, err = c.ListDevices(ctx, 0); err != nil || len(list) != 2 {
+		t.Fatalf("ListDevices(0) = %v, %v, want 2 devices", list, err)
+	}
+
+	if err := c.DeleteDevice(ctx, "beagle-2", "stale"); !isStatus(err, http.StatusPreconditionFailed) {
+		t.Fatalf("DeleteDevice with a stale etag: err = %v, want 412", err)
+	}
+	if err := c.DeleteDevice(ctx, "beagle-2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetDevice(ctx, "beagle-2"); !isStatus(err, http.StatusNotFound) {
+		t.Fatalf("GetDevice after delete: err = %v, want 404", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Twin is a device or module twin.
+type Twin struct {
+	DeviceID                  string                 `json:"deviceId,omitempty"`
+	ModuleID                  string                 `json:"moduleId,omitempty"`
+	ETag                      string                 `json:"etag,omitempty"`
+	DeviceETag                string                 `json:"deviceEtag,omitempty"`
+	Status                    string                 `json:"status,omitempty"`
+	StatusReason              string                 `json:"statusReason,omitempty"`
+	StatusUpdateTime          *time.Time             `json:"statusUpdateTime,omitempty"`
+	ConnectionState           string                 `json:"connectionState,omitempty"`
+	LastActivityTime          *time.Time             `json:"lastActivityTime,omitempty"`
+	CloudToDeviceMessageCount int                    `json:"cloudToDeviceMessageCount,omitempty"`
+	AuthenticationType        string                 `json:"authenticationType,omitempty"`
+	X509Thumbprint            *X509Thumbprint        `json:"x509Thumbprint,omitempty"`
+	Version                   int                    `json:"version,omitempty"`
+	Tags                      map[string]interface{} `json:"tags,omitempty"`
+	Properties                *TwinProperties        `json:"properties,omitempty"`
+	Capabilities              map[string]interface{} `json:"capabilities,omitempty"`
+}
+
+// TwinProperties are the desired and reported properties of a twin.
+type TwinProperties struct {
+	Desired  map[string]interface{} `json:"desired,omitempty"`
+	Reported map[string]interface{} `json:"reported,omitempty"`
+}
+
+func twinPath(deviceID string) string {
+	return "/twins/" + url.PathEscape(deviceID)
+}
+
+func moduleTwinPath(deviceID, moduleID string) string {
+	return twinPath(deviceID) + "/modules/" + url.PathEscape(moduleID)
+}
+
+// GetTwin returns the twin of a device.
+func (c *Client) GetTwin(ctx context.Context, deviceID string) (*Twin, error) {
+	return c.twin(ctx, http.MethodGet, twinPath(deviceID), nil)
+}
+
+// ReplaceTwin replaces the tags and desired properties of the device twin,
+// failing if the twin changed since twin.ETag was read.
+func (c *Client) ReplaceTwin(ctx context.Context, deviceID string, twin *Twin) (*Twin, error) {
+	return c.twin(ctx, http.MethodPut, twinPath(deviceID), twin)
+}
+
+// UpdateTwin merges the tags and desired properties of the patch into the device twin,
+// failing if the twin changed since patch.ETag was read. Properties set to nil are removed.
+func (c *Client) UpdateTwin(ctx context.Context, deviceID string, patch *Twin) (*Twin, error) {
+	return c.twin(ctx, http.MethodPatch, twinPath(deviceID), patch)
+}
+
+// GetModuleTwin returns the twin of a module.
+func (c *Client) GetModuleTwin(ctx context.Context, deviceID, moduleID string) (*Twin, error) {
+	return c.twin(ctx, http.MethodGet, moduleTwinPath(deviceID, moduleID), nil)
+}
+
+// ReplaceModuleTwin is ReplaceTwin for modules.
+func (c *Client) ReplaceModuleTwin(ctx context.Context, deviceID, moduleID string, twin *Twin) (*Twin, error) {
+	return c.twin(ctx, http.MethodPut, moduleTwinPath(deviceID, moduleID), twin)
+}
+
+// UpdateModuleTwin is UpdateTwin for modules.
+func (c *Client) UpdateModuleTwin(ctx context.Context, deviceID, moduleID string, patch *Twin) (*Twin, error) {
+	return c.twin(ctx, http.MethodPatch, moduleTwinPath(deviceID, moduleID), patch)
+}
+
+func (c *Client) twin(ctx context.Context, method, path string, in *Twin) (*Twin, error) {
+	// a nil *Twin isn't a nil interface{}
+	var header http.Header
+	var body interface{}
+	if in != nil {
+		header, body = ifMatch(in.ETag), in
+	}
+	var res Twin
+	if _, err := c.call(ctx, method, path, nil, header, body, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
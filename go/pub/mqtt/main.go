@@ -56,6 +56,7 @@ func init() {
 
 	// TODO: Need to manually generate SAS for now
 	// az iot hub generate-sas-token -d sebEdgeDevice -n seb-hub --du 28800
+	// or without az CLI, see go/sas: sas device -host seb-hub.azure-devices.net -device sebEdgeDevice -key <device key> -du 8h
 	opts.SetPassword("SharedAccessSignature sr=<hubname>.azure-devices.net%2Fdevices%2F<device name>&sig=...&se=...")
 
 	opts.OnConnect = connectHandler
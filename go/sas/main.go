@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: sas <command> [flags]
+
+Generates shared access signature tokens, so no az CLI is needed.
+
+Commands:
+  device    device token, e.g. the MQTT password of a device
+  module    module token
+  service   IoT Hub service policy token
+  dps       provisioning service device registration token
+  eventhub  Event Hub token
+  decode    decode a token, reporting its resource and expiry
+
+Examples:
+  sas device -cs "HostName=seb-hub.azure-devices.net;DeviceId=sebBeagle;SharedAccessKey=..." -du 24h
+  sas module -host seb-hub.azure-devices.net -device sebEdgeDevice -module NodeJsModuleId -key ...
+  sas service -cs "HostName=seb-hub.azure-devices.net;SharedAccessKeyName=service;SharedAccessKey=..."
+  sas dps -scope 0ne0012345 -registration sebBeagle -group-key ...
+  sas eventhub -cs "Endpoint=sb://...servicebus.windows.net/;SharedAccessKeyName=service;SharedAccessKey=...;EntityPath=..."
+  sas decode -key ... "SharedAccessSignature sr=...&sig=...&se=..."
+`
+
+func errorf(format string, v ...interface{}) error {
+	return fmt.Errorf("sas: "+format, v...)
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cmd, args := os.Args[1], os.Args[2:]
+	var err error
+	switch cmd {
+	case "device", "module", "service", "dps", "eventhub":
+		err = generate(cmd, args)
+	case "decode":
+		err = decode(args)
+	case "-h", "-help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "sas: unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generate generates a token of the given kind.
+func generate(kind string, args []string) error {
+	fs := flag.NewFlagSet(kind, flag.ExitOnError)
+	csPtr := fs.String("cs", "", "connection string, instead of -host, -device, -module, -policy and -key")
+	hostPtr := fs.String("host", "", "IoT Hub host name, e.g. seb-hub.azure-devices.net")
+	devicePtr := fs.String("device", "", "device ID")
+	modulePtr := fs.String("module", "", "module ID")
+	keyPtr := fs.String("key", "", "base64 shared access key")
+	policyPtr := fs.String("policy", "", "shared access policy name, the skn field")
+	scopePtr := fs.String("scope", "", "provisioning service ID scope")
+	regPtr := fs.String("registration", "", "provisioning service registration ID")
+	groupKeyPtr := fs.String("group-key", "", "enrollment group key to derive the device key from")
+	endpointPtr := fs.String("endpoint", "", "Event Hub endpoint, e.g. sb://<namespace>.servicebus.windows.net/")
+	entityPtr := fs.String("entity", "", "Event Hub entity path")
+	duPtr := fs.Duration("du", time.Hour, "token lifetime")
+	outPtr := fs.String("o", "token", "output, token or export")
+	varPtr := fs.String("var", "SAS_TOKEN", "variable name of the export line")
+	fs.Parse(args)
+
+	sak := &SharedAccessKey{
+		HostName:            *hostPtr,
+		SharedAccessKeyName: *policyPtr,
+		SharedAccessKey:     *keyPtr,
+	}
+	deviceID, moduleID := *devicePtr, *modulePtr
+	endpoint, entity := *endpointPtr, *entityPtr
+	if *csPtr != "" {
+		cs, err := ParseConnectionString(*csPtr)
+		if err != nil {
+			return err
+		}
+		sak.HostName = cs.HostName
+		sak.SharedAccessKey = cs.SharedAccessKey
+		if sak.SharedAccessKeyName == "" {
+			sak.SharedAccessKeyName = cs.SharedAccessKeyName
+		}
+		if deviceID == "" {
+			deviceID = cs.DeviceID
+		}
+		if moduleID == "" {
+			moduleID = cs.ModuleID
+		}
+		endpoint, entity = cs.Endpoint, cs.EntityPath
+		if *entityPtr != "" {
+			entity = *entityPtr
+		}
+	}
+
+	var resource string
+	switch kind {
+	case "device":
+		if sak.HostName == "" || deviceID == "" {
+			return errorf("device token needs a host and device ID")
+		}
+		resource = DeviceResource(sak.HostName, deviceID)
+	case "module":
+		if sak.HostName == "" || deviceID == "" || moduleID == "" {
+			return errorf("module token needs a host, device ID and module ID")
+		}
+		resource = ModuleResource(sak.HostName, deviceID, moduleID)
+	case "service":
+		if sak.HostName == "" || sak.SharedAccessKeyName == "" {
+			return errorf("service token needs a host and policy name")
+		}
+		resource = sak.HostName
+	case "dps":
+		if *scopePtr == "" || *regPtr == "" {
+			return errorf("dps token needs an ID scope and registration ID")
+		}
+		if *groupKeyPtr != "" {
+			key, err := DeriveKey(*groupKeyPtr, *regPtr)
+			if err != nil {
+				return err
+			}
+			sak.SharedAccessKey = key
+		}
+		if sak.SharedAccessKeyName == "" {
+			sak.SharedAccessKeyName = "registration"
+		}
+		resource = DPSResource(*scopePtr, *regPtr)
+	case "eventhub":
+		if endpoint == "" || sak.SharedAccessKeyName == "" {
+			return errorf("eventhub token needs an endpoint and policy name")
+		}
+		resource = EventHubResource(endpoint, entity)
+	}
+	if sak.SharedAccessKey == "" {
+		return errorf("no key given, use -key, -group-key or -cs")
+	}
+
+	sas, err := sak.Token(resource, *duPtr)
+	if err != nil {
+		return err
+	}
+	switch *outPtr {
+	case "token":
+		fmt.Println(sas.String())
+	case "export":
+		fmt.Printf("export %s='%s'\n", *varPtr, sas.String())
+	default:
+		return errorf("unknown output %q", *outPtr)
+	}
+	return nil
+}
+
+// decode prints the fields of a token and checks its signature when a key is given.
+func decode(args []string) error {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	keyPtr := fs.String("key", "", "base64 shared access key to verify the signature with")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errorf("decode needs a token")
+	}
+
+	sas, err := ParseSharedAccessSignature(strings.Join(fs.Args(), " "))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("resource: %s\n", sas.Sr)
+	if sas.Skn != "" {
+		fmt.Printf("policy:   %s\n", sas.Skn)
+	}
+	fmt.Printf("expiry:   %s\n", sas.Se.UTC().Format(time.RFC3339))
+	if left := time.Until(sas.Se); left > 0 {
+		fmt.Printf("expires:  in %s\n", left.Round(time.Second))
+	} else {
+		fmt.Printf("expires:  expired %s ago\n", (-left).Round(time.Second))
+	}
+	if *keyPtr != "" {
+		if err := sas.Verify(*keyPtr); err != nil {
+			return err
+		}
+		fmt.Println("signature: ok")
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+// This file is shared with go/iotservice/sas.go, keep both copies in sync.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ====================================================================================
+// SharedAccessKey is SAS token generator.
+type SharedAccessKey struct {
+	HostName            string
+	SharedAccessKeyName string
+	SharedAccessKey     string
+}
+
+// Token generates a shared access signature for the named resource and lifetime.
+func (c *SharedAccessKey) Token(
+	resource string, lifetime time.Duration,
+) (*SharedAccessSignature, error) {
+	return NewSharedAccessSignature(
+		resource, c.SharedAccessKeyName, c.SharedAccessKey, time.Now().Add(lifetime),
+	)
+}
+
+// NewSharedAccessSignature initialized a new shared access signature
+// and generates signature fields based on the given input.
+func NewSharedAccessSignature(
+	resource, policy, key string, expiry time.Time,
+) (*SharedAccessSignature, error) {
+	sig, err := mksig(resource, key, expiry)
+	if err != nil {
+		return nil, err
+	}
+	return &SharedAccessSignature{
+		Sr:  resource,
+		Sig: sig,
+		Se:  expiry,
+		Skn: policy,
+	}, nil
+}
+
+func mksig(sr, key string, se time.Time) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, b)
+	if _, err := fmt.Fprintf(h, "%s\n%d", url.QueryEscape(sr), se.Unix()); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// SharedAccessSignature is a shared access signature instance.
+type SharedAccessSignature struct {
+	Sr  string
+	Sig string
+	Se  time.Time
+	Skn string
+}
+
+// String converts the signature to a token string.
+func (sas *SharedAccessSignature) String() string {
+	s := "SharedAccessSignature " +
+		"sr=" + url.QueryEscape(sas.Sr) +
+		"&sig=" + url.QueryEscape(sas.Sig) +
+		"&se=" + url.QueryEscape(strconv.FormatInt(sas.Se.Unix(), 10))
+	if sas.Skn != "" {
+		s += "&skn=" + url.QueryEscape(sas.Skn)
+	}
+	return s
+}
+
+// ====================================================================================
+
+// ParseSharedAccessSignature parses a token string made by String.
+func ParseSharedAccessSignature(s string) (*SharedAccessSignature, error) {
+	const prefix = "SharedAccessSignature "
+	if !strings.HasPrefix(s, prefix) {
+		return nil, fmt.Errorf("sas: token doesn't start with %q", strings.TrimSpace(prefix))
+	}
+	v, err := url.ParseQuery(strings.TrimPrefix(s, prefix))
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range []string{"sr", "sig", "se"} {
+		if v.Get(k) == "" {
+			return nil, fmt.Errorf("sas: token has no %s field", k)
+		}
+	}
+	se, err := strconv.ParseInt(v.Get("se"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("sas: bad expiry %q", v.Get("se"))
+	}
+	return &SharedAccessSignature{
+		Sr:  v.Get("sr"),
+		Sig: v.Get("sig"),
+		Se:  time.Unix(se, 0),
+		Skn: v.Get("skn"),
+	}, nil
+}
+
+// Verify checks the signature against the given key.
+func (sas *SharedAccessSignature) Verify(key string) error {
+	sig, err := mksig(sas.Sr, key, sas.Se)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(sig), []byte(sas.Sig)) {
+		return errors.New("sas: signature mismatch")
+	}
+	return nil
+}
+
+// ConnectionString holds the fields of an IoT Hub, device, module or Event Hub connection string.
+type ConnectionString struct {
+	HostName            string
+	DeviceID            string
+	ModuleID            string
+	SharedAccessKeyName string
+	SharedAccessKey     string
+
+	// Event Hub connection strings have an endpoint and entity path instead of a host name.
+	Endpoint   string
+	EntityPath string
+}
+
+// ParseConnectionString parses a connection string of semicolon separated key=value pairs.
+func ParseConnectionString(cs string) (*ConnectionString, error) {
+	c := &ConnectionString{}
+	for _, kv := range strings.Split(cs, ";") {
+		if kv == "" {
+			continue
+		}
+		// keys end with '=' padding, so only split on the first one
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("sas: malformed connection string field %q", kv)
+		}
+		k, v := kv[:i], kv[i+1:]
+		switch k {
+		case "HostName":
+			c.HostName = v
+		case "DeviceId":
+			c.DeviceID = v
+		case "ModuleId":
+			c.ModuleID = v
+		case "SharedAccessKeyName":
+			c.SharedAccessKeyName = v
+		case "SharedAccessKey":
+			c.SharedAccessKey = v
+		case "Endpoint":
+			c.Endpoint = v
+		case "EntityPath":
+			c.EntityPath = v
+		}
+	}
+	if c.SharedAccessKey == "" {
+		return nil, errors.New("sas: connection string has no SharedAccessKey")
+	}
+	return c, nil
+}
+
+// DeviceResource is the resource of a device token.
+func DeviceResource(host, deviceID string) string {
+	return host + "/devices/" + deviceID
+}
+
+// ModuleResource is the resource of a module token.
+func ModuleResource(host, deviceID, moduleID string) string {
+	return DeviceResource(host, deviceID) + "/modules/" + moduleID
+}
+
+// DPSResource is the resource of a device registration token for the provisioning service.
+func DPSResource(idScope, registrationID string) string {
+	return idScope + "/registrations/" + registrationID
+}
+
+// EventHubResource is the resource of an Event Hub token,
+// endpoint is sb://<namespace>.servicebus.windows.net/ as found in connection strings.
+func EventHubResource(endpoint, entityPath string) string {
+	host := strings.TrimSuffix(strings.TrimPrefix(endpoint, "sb://"), "/")
+	r := "https://" + host + "/"
+	if entityPath != "" {
+		r += entityPath
+	}
+	return r
+}
+
+// DeriveKey derives a device key from a DPS enrollment group key.
+func DeriveKey(groupKey, registrationID string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(groupKey)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, b)
+	h.Write([]byte(registrationID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// Checkpoint is the last event processed on a partition.
+type Checkpoint struct {
+	Offset         string    `json:"offset"`
+	SequenceNumber int64     `json:"sequenceNumber"`
+	EnqueuedTime   time.Time `json:"enqueuedTime"`
+	Updated        time.Time `json:"updated"`
+}
+
+// CheckpointStore keeps the checkpoints of the partitions of event hubs,
+// per hub, consumer group and partition.
+type CheckpointStore interface {
+	// Load returns the checkpoint of the partition, nil when there's none.
+	Load(hub, group, partition string) (*Checkpoint, error)
+
+	// Save replaces the checkpoints of the partitions, by partition, in one go.
+	Save(hub, group string, cps map[string]*Checkpoint) error
+}
+
+// FileCheckpointStore keeps checkpoints in a local JSON file,
+// rewritten as a whole on every save.
+type FileCheckpointStore struct {
+	mu   sync.Mutex
+	path string
+	cps  map[string]*Checkpoint // hub/group/partition -> checkpoint
+}
+
+// NewFileCheckpointStore reads the checkpoints of the file, it's created on the first save.
+func NewFileCheckpointStore(path string) (*FileCheckpointStore, error) {
+	s := &FileCheckpointStore{path: path, cps: map[string]*Checkpoint{}}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.cps); err != nil {
+		return nil, errorf("checkpoints %s: %v", path, err)
+	}
+	return s, nil
+}
+
+func checkpointKey(hub, group, partition string) string {
+	return hub + "/" + group + "/" + partition
+}
+
+// Load implements CheckpointStore.
+func (s *FileCheckpointStore) Load(hub, group, partition string) (*Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp, ok := s.cps[checkpointKey(hub, group, partition)]
+	if !ok {
+		return nil, nil
+	}
+	c := *cp
+	return &c, nil
+}
+
+// Save implements CheckpointStore, the file is written once and replaced
+// through a rename so a crash leaves either the old or the new checkpoints.
+func (s *FileCheckpointStore) Save(hub, group string, cps map[string]*Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for partition, cp := range cps {
+		c := *cp
+		s.cps[checkpointKey(hub, group, partition)] = &c
+	}
+
+	b, err := json.MarshalIndent(s.cps, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// checkpointer saves the checkpoints of processed events every n events
+// or interval, whichever comes first.
+// Events are recorded in memory, saves happen outside of c.mu so recording
+// never waits on the disk, one at a time so an older save can't win.
+type checkpointer struct {
+	store    CheckpointStore
+	every    int
+	interval time.Duration
+
+	saveMu     sync.Mutex
+	mu         sync.Mutex
+	hub, group string
+	pending    map[string]*Checkpoint // partition -> checkpoint not saved yet
+	count      int
+	saved      time.Time
+}
+
+// WithSubscribeCheckpoints resumes partitions after their checkpoint in the store,
+// and saves the checkpoints of the events handled successfully every n events
+// or interval, zero disables either. Partitions without a checkpoint start
+// at the subscription start position.
+func WithSubscribeCheckpoints(store CheckpointStore, every int, interval time.Duration) SubscribeOption {
+	return func(s *sub) {
+		s.checkpoints = &checkpointer{store: store, every: every, interval: interval}
+	}
+}
+
+// start returns the start position of the partition after its checkpoint, if any.
+func (c *checkpointer) start(partition string) (StartPosition, bool, error) {
+	cp, err := c.store.Load(c.hub, c.group, partition)
+	if err != nil || cp == nil {
+		return StartPosition{}, false, err
+	}
+	log.Printf("partition %s resumes after offset %s, sequence number %d\n",
+		partition, cp.Offset, cp.SequenceNumber)
+	return StartAtOffset(cp.Offset, false), true, nil
+}
+
+// processed records the message of the partition as handled,
+// the checkpoints are saved by flush.
+func (c *checkpointer) processed(partition string, msg *amqp.Message) {
+	offset, _ := msg.Annotations["x-opt-offset"].(string)
+	if offset == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seq, _ := msg.Annotations["x-opt-sequence-number"].(int64)
+	enqueued, _ := msg.Annotations["x-opt-enqueued-time"].(time.Time)
+	c.pending[partition] = &Checkpoint{
+		Offset:         offset,
+		SequenceNumber: seq,
+		EnqueuedTime:   enqueued,
+	}
+	c.count++
+}
+
+// due reports whether the checkpoints are to be saved, by count or time.
+func (c *checkpointer) due() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pending) > 0 &&
+		(c.every > 0 && c.count >= c.every || c.interval > 0 && time.Since(c.saved) >= c.interval)
+}
+
+// last returns the checkpoint of the last event processed on the partition,
+// saved or not, nil when there's none.
+func (c *checkpointer) last(partition string) (*Checkpoint, error) {
+	c.mu.Lock()
+	cp, ok := c.pending[partition]
+	c.mu.Unlock()
+	if ok {
+		cc := *cp
+		return &cc, nil
+	}
+	return c.store.Load(c.hub, c.group, partition)
+}
+
+// flush saves the pending checkpoints in one store write.
+func (c *checkpointer) flush() error {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	c.mu.Lock()
+	cps := c.pending
+	now := time.Now()
+	c.pending, c.count, c.saved = map[string]*Checkpoint{}, 0, now
+	c.mu.Unlock()
+	if len(cps) == 0 {
+		return nil
+	}
+
+	for _, cp := range cps {
+		cp.Updated = now
+	}
+	err := c.store.Save(c.hub, c.group, cps)
+	if err != nil {
+		// kept for the next save, unless newer ones came in meanwhile
+		c.mu.Lock()
+		for partition, cp := range cps {
+			if _, ok := c.pending[partition]; !ok {
+				c.pending[partition] = cp
+			}
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
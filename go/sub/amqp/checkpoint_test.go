@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "checkpoints.json")
+	s, err := NewFileCheckpointStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp, err := s.Load("hub", "$Default", "0"); cp != nil || err != nil {
+		t.Fatalf("Load before a save = %v, %v, want none", cp, err)
+	}
+
+	enqueued := time.Date(2021, 4, 5, 14, 0, 0, 0, time.UTC)
+	if err := s.Save("hub", "$Default", map[string]*Checkpoint{
+		"0": {Offset: "100", SequenceNumber: 10, EnqueuedTime: enqueued},
+		"1": {Offset: "200", SequenceNumber: 20, EnqueuedTime: enqueued},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// a later save of one partition keeps the others
+	if err := s.Save("hub", "$Default", map[string]*Checkpoint{"1": {Offset: "300", SequenceNumber: 30}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save("hub", "other", map[string]*Checkpoint{"0": {Offset: "5", SequenceNumber: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is replaced, no temporary file is left behind
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "checkpoints.json" {
+		t.Fatalf("files = %v, want only checkpoints.json", files)
+	}
+
+	// read back from the file
+	r, err := NewFileCheckpointStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		group, partition string
+		offset           string
+		seq              int64
+	}{
+		{"$Default", "0", "100", 10},
+		{"$Default", "1", "300", 30},
+		{"other", "0", "5", 1},
+		{"other", "1", "", 0},
+	}
+	for _, tt := range tests {
+		cp, err := r.Load("hub", tt.group, tt.partition)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.offset == "" {
+			if cp != nil {
+				t.Errorf("%s/%s = %+v, want none", tt.group, tt.partition, cp)
+			}
+			continue
+		}
+		if cp == nil || cp.Offset != tt.offset || cp.SequenceNumber != tt.seq {
+			t.Errorf("%s/%s = %+v, want offset %s, sequence number %d", tt.group, tt.partition, cp, tt.offset, tt.seq)
+		}
+	}
+	if cp, _ := r.Load("hub", "$Default", "0"); !cp.EnqueuedTime.Equal(enqueued) {
+		t.Fatalf("enqueued time = %v, want %v", cp.EnqueuedTime, enqueued)
+	}
+
+	// a bad file is an error, not an empty store
+	if err := ioutil.WriteFile(file, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileCheckpointStore(file); err == nil {
+		t.Fatal("bad checkpoints file: want an error")
+	}
+}
+
+// failingStore fails its saves while fail is set.
+type failingStore struct {
+	fail  bool
+	saved map[string]*Checkpoint
+}
+
+func (s *failingStore) Load(hub, group, partition string) (*Checkpoint, error) {
+	return s.saved[partition], nil
+}
+
+func (s *failingStore) Save(hub, group string, cps map[string]*Checkpoint) error {
+	if s.fail {
+		return errors.New("disk full")
+	}
+	for partition, cp := range cps {
+		s.saved[partition] = cp
+	}
+	return nil
+}
+
+func testEvent(offset string, seq int64) *amqp.Message {
+	return &amqp.Message{Annotations: amqp.Annotations{
+		"x-opt-offset":          offset,
+		"x-opt-sequence-number": seq,
+	}}
+}
+
+func TestCheckpointer(t *testing.T) {
+	store := &failingStore{saved: map[string]*Checkpoint{}}
+	c := &checkpointer{store: store, every: 3, pending: map[string]*Checkpoint{}, saved: time.Now()}
+
+	c.processed("0", testEvent("100", 1))
+	c.processed("0", &amqp.Message{}) // no offset, ignored
+	c.processed("1", testEvent("500", 7))
+	if c.due() {
+		t.Fatal("due after 2 events, want after 3")
+	}
+	c.processed("0", testEvent("110", 2))
+	if !c.due() {
+		t.Fatal("not due after 3 events")
+	}
+	if cp, _ := c.last("0"); cp == nil || cp.Offset != "110" {
+		t.Fatalf("last(0) = %+v, want the unsaved offset 110", cp)
+	}
+
+	// a failed save keeps the checkpoints, newer ones win
+	store.fail = true
+	if err := c.flush(); err == nil {
+		t.Fatal("flush to a failing store: want an error")
+	}
+	c.processed("0", testEvent("120", 3))
+	store.fail = false
+	if err := c.flush(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		partition, offset string
+		seq               int64
+	}{
+		{"0", "120", 3},
+		{"1", "500", 7},
+	}
+	for _, tt := range tests {
+		cp := store.saved[tt.partition]
+		if cp == nil || cp.Offset != tt.offset || cp.SequenceNumber != tt.seq || cp.Updated.IsZero() {
+			t.Errorf("partition %s saved %+v, want offset %s, sequence number %d", tt.partition, cp, tt.offset, tt.seq)
+		}
+	}
+	if c.due() || len(c.pending) != 0 {
+		t.Fatalf("pending after a save = %v", c.pending)
+	}
+	if err := c.flush(); err != nil {
+		t.Fatalf("flush without pending checkpoints: %v", err)
+	}
+	if cp, _ := c.last("1"); cp == nil || cp.Offset != "500" {
+		t.Fatalf("last(1) = %+v, want the saved offset 500", cp)
+	}
+
+	// by interval
+	c = &checkpointer{store: store, interval: time.Minute, pending: map[string]*Checkpoint{}, saved: time.Now()}
+	c.processed("0", testEvent("130", 4))
+	if c.due() {
+		t.Fatal("due before the interval")
+	}
+	c.saved = time.Now().Add(-time.Minute)
+	if !c.due() {
+		t.Fatal("not due after the interval")
+	}
+
+	p, ok, err := c.start("0")
+	if err != nil || !ok || p != StartAtOffset("120", false) {
+		t.Fatalf("start(0) = %s, %v, %v, want after offset 120", p, ok, err)
+	}
+	if _, ok, _ := c.start("9"); ok {
+		t.Fatal("start of a partition without a checkpoint: want none")
+	}
+}
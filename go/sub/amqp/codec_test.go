@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const testAvroSchema = `{
+	"type": "record",
+	"name": "Reading",
+	"namespace": "seb.test",
+	"fields": [
+		{"name": "sensor", "type": "string"},
+		{"name": "value", "type": "double"}
+	]
+}`
+
+// testSchemas writes an avro schema and a protobuf descriptor set
+// of seb.test.Reading to a temporary directory and loads them.
+func testSchemas(t *testing.T) *SchemaRegistry {
+	t.Helper()
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "reading.avsc"), []byte(testAvroSchema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("reading.proto"),
+		Package: proto.String("seb.test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Reading"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:     proto.String("sensor"),
+				JsonName: proto.String("sensor"),
+				Number:   proto.Int32(1),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			}, {
+				Name:     proto.String("value"),
+				JsonName: proto.String("value"),
+				Number:   proto.Int32(2),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_DOUBLE.Enum(),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			}},
+		}},
+	}}}
+	b, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "reading.pb"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := loadSchemaRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	r := testSchemas(t)
+	doc := map[string]interface{}{"sensor": "temp-1", "value": 21.5}
+	tests := []struct {
+		encoding, schema string
+		contentType      string
+	}{
+		{"json", "", ContentTypeJSON},
+		{"cbor", "", ContentTypeCBOR},
+		{"protobuf", "seb.test.Reading", ContentTypeProtobuf + "; messagetype=seb.test.Reading"},
+		{"avro", "seb.test.Reading", ContentTypeAvro + "; schema=seb.test.Reading"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			c, err := r.Codec(tt.encoding, tt.schema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.ContentType() != tt.contentType {
+				t.Fatalf("ContentType = %q, want %q", c.ContentType(), tt.contentType)
+			}
+			b, err := c.Encode(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// decoded by content type, as the subscriber does
+			dc, err := r.CodecFor(c.ContentType())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := dc.Decode(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, doc) {
+				t.Fatalf("Decode = %v, want %v", got, doc)
+			}
+		})
+	}
+
+	if _, err := r.Codec("protobuf", "seb.test.Nope"); err == nil {
+		t.Fatal("Codec of an unknown message type: want an error")
+	}
+	if _, err := r.CodecFor("text/plain"); err == nil {
+		t.Fatal("CodecFor(text/plain): want an error")
+	}
+	if c, err := r.CodecFor(""); err != nil || c.ContentType() != ContentTypeJSON {
+		t.Fatalf("CodecFor(\"\") = %v, %v, want JSON", c, err)
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	b := bytes.Repeat([]byte(`{"sensor":"temp-1","value":21.5}`), 100)
+	for _, enc := range []string{ContentEncodingGzip, ContentEncodingZstd} {
+		c, err := compress(enc, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c) >= len(b) {
+			t.Fatalf("%s: compressed %d bytes to %d", enc, len(b), len(c))
+		}
+		d, err := decompress(enc, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(d, b) {
+			t.Fatalf("%s: decompress doesn't give back the payload", enc)
+		}
+	}
+	if d, err := decompress("utf-8", b); err != nil || !bytes.Equal(d, b) {
+		t.Fatalf("decompress(utf-8) = %v, want the payload as it is", err)
+	}
+	if _, err := compress("br", b); err == nil {
+		t.Fatal("compress(br): want an error")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	for _, enc := range []string{ContentEncodingGzip, ContentEncodingZstd} {
+		ok := make([]byte, maxDecompressedSize)
+		c, err := compress(enc, ok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d, err := decompress(enc, c); err != nil || len(d) != maxDecompressedSize {
+			t.Fatalf("%s: decompress of %d bytes: %d, %v", enc, maxDecompressedSize, len(d), err)
+		}
+
+		bomb := make([]byte, maxDecompressedSize+1)
+		if c, err = compress(enc, bomb); err != nil {
+			t.Fatal(err)
+		}
+		if len(c) > MaxMessageSize {
+			t.Fatalf("%s: bomb of %d bytes doesn't fit a message", enc, len(c))
+		}
+		if _, err := decompress(enc, c); err != errTooLarge {
+			t.Fatalf("%s: decompress of a bomb: err = %v, want %v", enc, err, errTooLarge)
+		}
+	}
+}
+
+func TestSplitFrames(t *testing.T) {
+	docs := [][]byte{[]byte(`{"a":1}`), {}, bytes.Repeat([]byte("x"), 300)}
+	var batch []byte
+	for _, d := range docs {
+		batch = appendFrame(batch, d)
+	}
+	frames, err := splitFrames(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != len(docs) {
+		t.Fatalf("splitFrames = %d frames, want %d", len(frames), len(docs))
+	}
+	for i := range docs {
+		if !bytes.Equal(frames[i], docs[i]) {
+			t.Fatalf("frame %d = %q, want %q", i, frames[i], docs[i])
+		}
+	}
+	if frames, err := splitFrames(nil); err != nil || len(frames) != 0 {
+		t.Fatalf("splitFrames(nil) = %v, %v", frames, err)
+	}
+
+	var huge [binary.MaxVarintLen64]byte
+	malformed := map[string][]byte{
+		"truncated payload":   batch[:len(batch)-1],
+		"truncated length":    appendFrame(nil, docs[2])[:1],
+		"length past the end": huge[:binary.PutUvarint(huge[:], 1<<62)],
+		"varint overflow":     bytes.Repeat([]byte{0xff}, binary.MaxVarintLen64+1),
+	}
+	for name, b := range malformed {
+		if _, err := splitFrames(b); err == nil {
+			t.Errorf("splitFrames of a %s: want an error", name)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func init() {
+	metrics.Help("amqpsub_handler_retries_total", "Handler calls retried after an error.")
+	metrics.Help("amqpsub_poison_messages_total", "Events the handler failed on after all retries.")
+	metrics.Help("amqpsub_dead_letters_total", "Events sent to the dead-letter sink.")
+	metrics.Help("amqpsub_dead_letter_errors_total", "Events the dead-letter sink failed to take.")
+}
+
+// DeadLetter is an event the handler kept failing on, with its last error.
+type DeadLetter struct {
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	Time     time.Time `json:"time"`
+	Event    *Message  `json:"event"`
+}
+
+// DeadLetterSink keeps the events the handler gave up on.
+type DeadLetterSink interface {
+	Send(ctx context.Context, dl *DeadLetter) error
+}
+
+// RetryPolicy retries failing handler calls with backoff, then sends the
+// event to the dead-letter sink and moves on to the next one.
+type RetryPolicy struct {
+	Retries    int           // retries after the first call
+	Backoff    time.Duration // wait before the first retry, doubled after every retry
+	MaxBackoff time.Duration
+	Sink       DeadLetterSink // nil returns the handler error, ending the subscription
+}
+
+// WithRetryPolicy retries failing handler calls and dead-letters events
+// instead of ending the subscription on the first handler error.
+func WithRetryPolicy(p *RetryPolicy) EventsOption {
+	return func(c *eventsConfig) {
+		c.retry = p
+	}
+}
+
+// handle calls fn with the event according to the policy,
+// it returns the handler error only when the event couldn't be dead-lettered.
+func (p *RetryPolicy) handle(ctx context.Context, fn EventHandler, e *Event) error {
+	b := &backoff{min: p.Backoff, max: p.MaxBackoff}
+	if b.max < b.min {
+		b.max = b.min
+	}
+	var err error
+	attempts := 0
+	for {
+		attempts++
+		if err = fn(e); err == nil {
+			return nil
+		}
+		if attempts > p.Retries {
+			break
+		}
+		log.Printf("handler error, retrying %d/%d: %v\n", attempts, p.Retries, err)
+		metrics.Inc("amqpsub_handler_retries_total")
+		if b.min > 0 {
+			if werr := b.wait(ctx); werr != nil {
+				return werr
+			}
+		}
+	}
+
+	metrics.Inc("amqpsub_poison_messages_total")
+	if p.Sink == nil {
+		return &HandlerError{err}
+	}
+	dl := &DeadLetter{Error: err.Error(), Attempts: attempts, Time: time.Now().UTC(), Event: e.Message}
+	if serr := p.Sink.Send(ctx, dl); serr != nil {
+		metrics.Inc("amqpsub_dead_letter_errors_total")
+		return &HandlerError{fmt.Errorf("%v, not dead-lettered: %v", err, serr)}
+	}
+	metrics.Inc("amqpsub_dead_letters_total")
+	log.Printf("event %s from %q dead-lettered after %d attempts: %v\n",
+		e.MessageID, e.ConnectionDeviceID, attempts, err)
+	return nil
+}
+
+// ParseDeadLetterSink returns the sink of a dead-letter target:
+//
+//	http://collector:8080/deadletters  POST to an HTTP endpoint
+//	mqtt://broker:1883/deadletters     publish to an MQTT topic, mqtts:// over TLS
+//	deadletters                        append to JSONL files in a local directory
+func ParseDeadLetterSink(target string) (DeadLetterSink, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return NewDirDeadLetterSink(target)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &HTTPDeadLetterSink{URL: target}, nil
+	case "mqtt", "tcp":
+		return NewMQTTDeadLetterSink("tcp://"+u.Host, strings.Trim(u.Path, "/"))
+	case "mqtts", "ssl", "tls":
+		return NewMQTTDeadLetterSink("ssl://"+u.Host, strings.Trim(u.Path, "/"))
+	}
+	return nil, errorf("unknown dead-letter target %q", target)
+}
+
+// DirDeadLetterSink appends dead letters to a JSONL file per day in a directory.
+type DirDeadLetterSink struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewDirDeadLetterSink returns a sink writing to dir, created when missing.
+func NewDirDeadLetterSink(dir string) (*DirDeadLetterSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirDeadLetterSink{dir: dir}, nil
+}
+
+// Send implements DeadLetterSink.
+func (s *DirDeadLetterSink) Send(ctx context.Context, dl *DeadLetter) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(s.dir, "deadletters-"+dl.Time.Format("2006-01-02")+".jsonl")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// HTTPDeadLetterSink POSTs dead letters as JSON to an URL.
+type HTTPDeadLetterSink struct {
+	URL    string
+	Client *http.Client // http.DefaultClient when nil
+}
+
+// Send implements DeadLetterSink.
+func (s *HTTPDeadLetterSink) Send(ctx context.Context, dl *DeadLetter) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c := s.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return errorf("dead-letter POST %s: %s", s.URL, res.Status)
+	}
+	return nil
+}
+
+// MQTTDeadLetterSink publishes dead letters as JSON to an MQTT topic, at QoS 1.
+type MQTTDeadLetterSink struct {
+	client mqtt.Client
+	topic  string
+}
+
+// NewMQTTDeadLetterSink connects to the broker, e.g. tcp://localhost:1883.
+func NewMQTTDeadLetterSink(broker, topic string) (*MQTTDeadLetterSink, error) {
+	if topic == "" {
+		return nil, errorf("no dead-letter topic for %s", broker)
+	}
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID(fmt.Sprintf("amqpsub-deadletter-%d", os.Getpid()))
+	opts.SetAutoReconnect(true)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	log.Printf("dead letters to %s topic %s\n", broker, topic)
+	return &MQTTDeadLetterSink{client: client, topic: topic}, nil
+}
+
+// Send implements DeadLetterSink.
+func (s *MQTTDeadLetterSink) Send(ctx context.Context, dl *DeadLetter) error {
+	b, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	token := s.client.Publish(s.topic, 1, false, b)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close disconnects from the broker.
+func (s *MQTTDeadLetterSink) Close() {
+	s.client.Disconnect(250)
+}
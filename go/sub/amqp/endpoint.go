@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/go-amqp"
+)
+
+// EventHubEndpoint is the Event Hub compatible endpoint of an IoT Hub,
+// where the hub redirects event subscribers to.
+type EventHubEndpoint struct {
+	Host        string // TLS server name, e.g. ihsuprodsgres013dednamespace.servicebus.windows.net
+	NetworkHost string // host to dial, the same as Host unless the hub says otherwise
+	Port        int
+	Name        string // event hub name, e.g. iothub-ehub-seb-hub-8717893-e68ae183bb
+}
+
+func (ep *EventHubEndpoint) addr() string {
+	return "amqps://" + net.JoinHostPort(ep.NetworkHost, strconv.Itoa(ep.Port))
+}
+
+// audience is the CBS audience of the event hub.
+func (ep *EventHubEndpoint) audience() string {
+	return "amqps://" + ep.Host + "/" + ep.Name
+}
+
+func (ep *EventHubEndpoint) String() string {
+	return ep.addr() + "/" + ep.Name
+}
+
+// parseRedirect reads the endpoint from the info of a link redirect error:
+//
+//	address:amqps://ihsuprodsgres013dednamespace.servicebus.windows.net:5671/iothub-ehub-seb-hub-8717893-e68ae183bb/
+//	hostname:ihsuprodsgres013dednamespace.servicebus.windows.net
+//	network-host:ihsuprodsgres013dednamespace.servicebus.windows.net
+//	port:5671
+func parseRedirect(rerr *amqp.Error) (*EventHubEndpoint, error) {
+	address, _ := rerr.Info["address"].(string)
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return nil, errorf("bad redirect address %q", address)
+	}
+	ep := &EventHubEndpoint{
+		Host: u.Hostname(),
+		Name: strings.Trim(u.Path, "/"),
+		Port: 5671,
+	}
+	if ep.Name == "" {
+		return nil, errorf("no event hub name in redirect address %q", address)
+	}
+	if p := u.Port(); p != "" {
+		if ep.Port, err = strconv.Atoi(p); err != nil {
+			return nil, errorf("bad redirect address %q", address)
+		}
+	}
+	if h, ok := rerr.Info["hostname"].(string); ok && h != "" {
+		ep.Host = h
+	}
+	ep.NetworkHost = ep.Host
+	if h, ok := rerr.Info["network-host"].(string); ok && h != "" {
+		ep.NetworkHost = h
+	}
+	switch p := rerr.Info["port"].(type) {
+	case int32:
+		ep.Port = int(p)
+	case int64:
+		ep.Port = int(p)
+	case string:
+		if n, err := strconv.Atoi(p); err == nil {
+			ep.Port = n
+		}
+	}
+	return ep, nil
+}
+
+// resolveEventHub finds the Event Hub compatible endpoint of the hub,
+// by subscribing to its events stream to be redirected.
+// The connection is only used for the redirect, the token is put once and
+// the manager closed, a refused token is returned as *TokenError.
+func resolveEventHub(ctx context.Context, c *amqp.Client, sak *SharedAccessKey) (*EventHubEndpoint, error) {
+	tm := NewTokenManager(ctx, c, sak)
+	defer tm.Close()
+	if err := tm.Put(ctx, sak.HostName); err != nil {
+		return nil, err
+	}
+	sess, err := c.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close(context.Background())
+
+	_, err = sess.NewReceiver(
+		amqp.LinkSourceAddress("messages/events/"),
+	)
+	if err == nil {
+		return nil, errorf("expected redirect error")
+	}
+	rerr, ok := err.(*amqp.Error)
+	if !ok || rerr.Condition != amqp.ErrorLinkRedirect {
+		log.Print("resolveEventHub Error:", err)
+		return nil, err
+	}
+	ep, err := parseRedirect(rerr)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", err, rerr)
+	}
+	log.Printf("resolveEventHub redirected to %s\n", ep)
+	return ep, nil
+}
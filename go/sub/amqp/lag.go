@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	metrics.Help("amqpsub_partition_last_sequence_number", "Sequence number of the last event enqueued on the partition.")
+	metrics.Help("amqpsub_partition_last_enqueued_timestamp_seconds", "Enqueued time of the last event of the partition, in Unix seconds.")
+	metrics.Help("amqpsub_partition_lag_events", "Events enqueued on the partition after the consumer group's checkpoint.")
+	metrics.Help("amqpsub_partition_lag_seconds", "Enqueued time of the last event of the partition minus that of the checkpoint.")
+}
+
+// WithSubscribeLagInterval reads the runtime info of the partitions every
+// interval and exports their consumer lag, against the checkpoints, as gauges.
+func WithSubscribeLagInterval(interval time.Duration) SubscribeOption {
+	return func(s *sub) {
+		s.lagInterval = interval
+	}
+}
+
+// reportLag sets the partition gauges of the hub, lag ones only with checkpoints.
+func (s *sub) reportLag(ctx context.Context, mc *managementClient, hub string, ids []string) error {
+	for _, id := range ids {
+		info, err := mc.partitionInfo(ctx, hub, id)
+		if err != nil {
+			return err
+		}
+		labels := []string{"group", s.group, "partition", id}
+		metrics.Set("amqpsub_partition_last_sequence_number", float64(info.LastEnqueuedSequenceNumber), labels...)
+		if !info.LastEnqueuedTime.IsZero() {
+			metrics.Set("amqpsub_partition_last_enqueued_timestamp_seconds",
+				float64(info.LastEnqueuedTime.UnixNano())/1e9, labels...)
+		}
+		if s.checkpoints == nil {
+			continue
+		}
+		cp, err := s.checkpoints.last(id)
+		if err != nil {
+			return err
+		}
+		metrics.Set("amqpsub_partition_lag_events", float64(info.lag(cp)), labels...)
+		if cp != nil && !cp.EnqueuedTime.IsZero() && info.LastEnqueuedTime.After(cp.EnqueuedTime) {
+			metrics.Set("amqpsub_partition_lag_seconds", info.LastEnqueuedTime.Sub(cp.EnqueuedTime).Seconds(), labels...)
+		} else {
+			metrics.Set("amqpsub_partition_lag_seconds", 0, labels...)
+		}
+	}
+	return nil
+}
+
+// monitorLag reports the lag every s.lagInterval until ctx is done,
+// errors are only logged, the subscription goes on without the gauges.
+func (s *sub) monitorLag(ctx context.Context, mc *managementClient, hub string, ids []string) {
+	if s.checkpoints == nil {
+		log.Printf("no checkpoints, partition lag not reported\n")
+	}
+	ticker := time.NewTicker(s.lagInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.reportLag(ctx, mc, hub, ids); err != nil && ctx.Err() == nil {
+			log.Printf("partition info error: %v\n", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// printStatus prints the runtime info of the partitions of the hub of sak
+// and their lag against the checkpoints of the consumer group, if a store is given.
+func printStatus(ctx context.Context, sak *SharedAccessKey, tc *tls.Config, group string, store CheckpointStore) error {
+	c, err := dialHub(sak, tc)
+	if err != nil {
+		return err
+	}
+	ep, err := resolveEventHub(ctx, c, sak)
+	c.Close()
+	if err != nil {
+		return err
+	}
+	eh, err := connectToEventHub(ctx, ep, sak, tc)
+	if err != nil {
+		return err
+	}
+	defer eh.Close()
+	sess, err := eh.conn.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close(context.Background())
+	mc, err := newManagementClient(sess)
+	if err != nil {
+		return err
+	}
+	defer mc.Close()
+	ids, err := mc.partitionIDs(ctx, eh.name)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "PARTITION\tBEGIN\tLAST\tLAST OFFSET\tLAST ENQUEUED\tCHECKPOINT\tLAG\n")
+	for _, id := range ids {
+		info, err := mc.partitionInfo(ctx, eh.name, id)
+		if err != nil {
+			return err
+		}
+		checkpoint, lag := "-", "-"
+		if store != nil {
+			cp, err := store.Load(eh.name, group, id)
+			if err != nil {
+				return err
+			}
+			if cp != nil {
+				checkpoint = fmt.Sprint(cp.SequenceNumber)
+			}
+			lag = fmt.Sprint(info.lag(cp))
+		}
+		last, offset, enqueued := "-", "-", "-"
+		if !info.Empty {
+			last = fmt.Sprint(info.LastEnqueuedSequenceNumber)
+			offset = info.LastEnqueuedOffset
+			enqueued = info.LastEnqueuedTime.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			id, info.BeginSequenceNumber, last, offset, enqueued, checkpoint, lag)
+	}
+	return w.Flush()
+}
@@ -11,11 +11,16 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Azure/go-amqp"
@@ -280,6 +285,10 @@ type Message struct {
 	// It contains the deviceId of the device that sent the message.
 	ConnectionDeviceID string `json:"ConnectionDeviceId,omitempty"`
 
+	// ConnectionModuleID is the moduleId of the module that sent the message,
+	// set by IoT Hub on device-to-cloud messages sent by modules.
+	ConnectionModuleID string `json:"ConnectionModuleId,omitempty"`
+
 	// ConnectionDeviceGenerationID is an ID set by IoT Hub on device-to-cloud messages.
 	// It contains the generationId (as per Device identity properties)
 	// of the device that sent the message.
@@ -293,12 +302,31 @@ type Message struct {
 	// MessageSource determines a device-to-cloud message transport.
 	MessageSource string `json:"MessageSource,omitempty"`
 
+	// ContentType and ContentEncoding describe the payload, e.g. application/json and gzip.
+	ContentType     string `json:"ContentType,omitempty"`
+	ContentEncoding string `json:"ContentEncoding,omitempty"`
+
+	// InterfaceID is the IoT Plug and Play interface the message belongs to,
+	// DataSchema the DTDL model ID and Component the component name.
+	InterfaceID string `json:"InterfaceId,omitempty"`
+	DataSchema  string `json:"DataSchema,omitempty"`
+	Component   string `json:"Component,omitempty"`
+
+	// SequenceNumber, Offset and PartitionKey locate the event in its Event Hub partition.
+	SequenceNumber int64  `json:"SequenceNumber,omitempty"`
+	Offset         string `json:"Offset,omitempty"`
+	PartitionKey   string `json:"PartitionKey,omitempty"`
+
 	// Payload is message data.
 	Payload []byte `json:"Payload,omitempty"`
 
 	// Properties are custom message properties (property bags).
 	Properties map[string]string `json:"Properties,omitempty"`
 
+	// TypedProperties are the same properties with their AMQP types,
+	// e.g. numbers used in routing queries.
+	TypedProperties map[string]*Property `json:"TypedProperties,omitempty"`
+
 	// TransportOptions transport specific options.
 	TransportOptions map[string]interface{} `json:"-"`
 }
@@ -318,6 +346,30 @@ type SharedAccessKey struct {
 	SharedAccessKey     string
 }
 
+// parseConnectionString parses a service connection string, like
+// HostName=seb-hub.azure-devices.net;SharedAccessKeyName=service;SharedAccessKey=...
+func parseConnectionString(cs string) (*SharedAccessKey, error) {
+	sak := &SharedAccessKey{}
+	for _, kv := range strings.Split(cs, ";") {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return nil, errorf("bad connection string element %q", kv)
+		}
+		switch kv[:i] {
+		case "HostName":
+			sak.HostName = kv[i+1:]
+		case "SharedAccessKeyName":
+			sak.SharedAccessKeyName = kv[i+1:]
+		case "SharedAccessKey":
+			sak.SharedAccessKey = kv[i+1:]
+		}
+	}
+	if sak.HostName == "" || sak.SharedAccessKeyName == "" || sak.SharedAccessKey == "" {
+		return nil, errorf("connection string needs HostName, SharedAccessKeyName and SharedAccessKey")
+	}
+	return sak, nil
+}
+
 // Token generates a shared access signature for the named resource and lifetime.
 func (c *SharedAccessKey) Token(
 	resource string, lifetime time.Duration,
@@ -387,225 +439,45 @@ func rootCAs() *x509.CertPool {
 	return p
 }
 
-// EventHandler handles incoming cloud-to-device events.
-//type EventHandler func(e *Event) error
-type EventHandler func(e *amqp.Message) error
+// EventHandler handles incoming device-to-cloud events.
+type EventHandler func(e *Event) error
 
 // Event is a device-to-cloud message.
 type Event struct {
 	*Message
-}
-
-const userAgent = "iothub-golang-sdk/dev"
 
-// putTokenContinuously writes token first time in blocking mode and returns
-// maintaining token updates in the background until the client is closed.
-func putTokenContinuously(ctx context.Context, conn *amqp.Client) error {
-	const (
-		tokenUpdateInterval = time.Hour
-
-		// we need to update tokens before they expire to prevent disconnects
-		// from azure, without interrupting the message flow
-		tokenUpdateSpan = 10 * time.Minute
-	)
-
-	sess, err := conn.NewSession()
-	if err != nil {
-		return err
-	}
-
-	if err := putToken(ctx, sess, tokenUpdateInterval); err != nil {
-		_ = sess.Close(context.Background())
-		return err
-	}
-
-	var done chan struct{}
-	go func() {
-		defer sess.Close(context.Background())
-		ticker := time.NewTimer(tokenUpdateInterval - tokenUpdateSpan)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ticker.C:
-				if err := putToken(context.Background(), sess, tokenUpdateInterval); err != nil {
-					log.Printf("put token error: %v\n", err)
-					return
-				}
-				ticker.Reset(tokenUpdateInterval - tokenUpdateSpan)
-				log.Println("token updated")
-			case <-done:
-				return
-			}
-		}
-	}()
-	return nil
+	raw *amqp.Message
 }
 
-func putToken(
-	ctx context.Context, sess *amqp.Session, lifetime time.Duration,
-) error {
-	send, err := sess.NewSender(
-		amqp.LinkTargetAddress("$cbs"),
-	)
-	if err != nil {
-		return err
-	}
-	defer send.Close(context.Background())
-
-	recv, err := sess.NewReceiver(
-		amqp.LinkSourceAddress("$cbs"),
-	)
-	if err != nil {
-		return err
-	}
-	defer recv.Close(context.Background())
-
-	// Seb: https://docs.microsoft.com/en-us/rest/api/eventhub/generate-sas-token
-	//      See the NodeJS version
-	sak := &SharedAccessKey{
-		HostName:            "seb-hub.azure-devices.net",
-		SharedAccessKeyName: "service",
-		SharedAccessKey:     "sTuhHHftCxGl35I0XtLV4B4GwQg8Di0t5nPjXYg6CqA=",
-	}
-	sas, err := sak.Token(sak.HostName, lifetime)
-	if err != nil {
-		log.Printf("putToken: %v\n", err)
-		return err
-	}
-	log.Printf("putToken generated: %s\n", sas.String())
-
-	if err = send.Send(ctx, &amqp.Message{
-		Value: sas.String(),
-		Properties: &amqp.MessageProperties{
-			To:      "$cbs",
-			ReplyTo: "cbs",
-		},
-		ApplicationProperties: map[string]interface{}{
-			"operation": "put-token",
-			"type":      "servicebus.windows.net:sastoken",
-			"name":      sak.HostName,
-		},
-	}); err != nil {
-		log.Printf("putToken send error: %v\n", err)
-		return err
-	}
-
-	msg, err := recv.Receive(ctx)
-	if err != nil {
-		log.Printf("putToken recv error: %v\n", err)
-		return err
-	}
-	if err = msg.Accept(ctx); err != nil {
-		log.Printf("putToken Accept error: %v\n", err)
-		return err
-	}
-	return checkMessageResponse(msg)
+// Raw returns the AMQP message the event was decoded from.
+func (e *Event) Raw() *amqp.Message {
+	return e.raw
 }
 
-// newSession connects to IoT Hub's AMQP broker,
-// it's needed for sending C2S events and subscribing to events feedback.
-//
-// It establishes connection only once, subsequent calls return immediately.
-func newSession(ctx context.Context, c *amqp.Client, tc *tls.Config) (*amqp.Session, error) {
-	//if c != nil {
-	//	return c.NewSession() // already connected
-	//}
-	sakHost := "seb-hub.azure-devices.net"
-	conn, err := amqp.Dial("amqps://"+sakHost, //c.sak.HostName,
-		amqp.ConnTLSConfig(tc),
-		amqp.ConnProperty("com.microsoft:client-version", userAgent),
-	)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		if err != nil {
-			_ = conn.Close()
-		}
-	}()
-
-	log.Printf("newSession connected to %s", sakHost)
-
-	if err = putTokenContinuously(ctx, conn); err != nil {
-		return nil, err
-	}
-
-	sess, err := conn.NewSession()
-	if err != nil {
-		return nil, err
-	}
-	//.conn = conn
-	return sess, nil
-}
-
-func connectToEventHub(c *amqp.Client, ctx context.Context, tc *tls.Config) (*amqp.Client, error) {
-	sess, err := newSession(ctx, c, tc)
-	if err != nil {
-		return nil, err
-	}
-
-	// iothub broker should redirect us to an eventhub compatible instance
-	// straight after subscribing to events stream, for that we need to connect twice
-	defer sess.Close(context.Background())
-
-	_, err = sess.NewReceiver(
-		amqp.LinkSourceAddress("messages/events/"),
-	)
-	if err == nil {
-		return nil, errorf("expected redirect error")
-	}
-	rerr, ok := err.(*amqp.Error)
-
-	/*
-		2021/04/05 14:49:17 connectToEventHub *Error{Condition: amqp:link:redirect,
-			Description: , Info: map[address:amqps://ihsuprodsgres013dednamespace.servicebus.windows.net:5671/iothub-ehub-seb-hub-8717893-e68ae183bb/ hostname:ihsuprodsgres013dednamespace.servicebus.windows.net network-host:ihsuprodsgres013dednamespace.servicebus.windows.net port:5671]}
-	*/
-	if !ok || rerr.Condition != amqp.ErrorLinkRedirect {
-		log.Print("connectToEventHub Error:", err)
-		return nil, err
-	}
-	log.Printf("connectToEventHub error is expected: %v", err.(*amqp.Error))
-
-	// "amqps://{host}:5671/{consumerGroup}/"
-	group := rerr.Info["address"].(string)
-	group = group[strings.Index(group, ":5671/")+6 : len(group)-1]
-
-	host := rerr.Info["hostname"].(string)
-	//c.logger.Debugf("redirected to %s:%s eventhub", host, group)
-
-	// Seb
-	log.Printf("connectToEventHub redirected to %s:%s iot eventhub", host, group)
+const userAgent = "iothub-golang-sdk/dev"
 
+// connectToEventHub connects to the Event Hub compatible endpoint of the hub,
+// authorized by a CBS token of sak that's renewed until the client is closed
+// or ctx is done, the client's tokens report when it couldn't be.
+func connectToEventHub(ctx context.Context, ep *EventHubEndpoint, sak *SharedAccessKey, tc *tls.Config) (*Client, error) {
 	tlsCloned := tc.Clone()
-	tlsCloned.ServerName = "ihsuprodsgres013dednamespace.servicebus.windows.net"
-	log.Printf("connectToEventHub tls ServerName: %s\n", tlsCloned.ServerName)
-	/*
-		amqpclient, err := amqp.Dial("amqps://"+"ihsuprodsgres013dednamespace.servicebus.windows.net",
-			amqp.ConnTLSConfig(tlsCloned),
-			amqp.ConnSASLPlain("service", "sTuhHHftCxGl35I0XtLV4B4GwQg8Di0t5nPjXYg6CqA="),
-			amqp.ConnOption(amqp.ConnProperty("com.microsoft:client-version", userAgent)),
-		)
-	*/
-	//log.Printf("connectToEventHub Dial sak: %+v\n", c.sak)
-	log.Printf("connectToEventHub group: %s\n", group)
-	amqpclient, err := dial("ihsuprodsgres013dednamespace.servicebus.windows.net", group,
+	tlsCloned.ServerName = ep.Host
+	log.Printf("connectToEventHub %s, tls ServerName: %s\n", ep, tlsCloned.ServerName)
+	eh, err := dial(ep.addr(), ep.Name,
 		WithTLSConfig(tlsCloned),
-		WithSASLPlain("service", "sTuhHHftCxGl35I0XtLV4B4GwQg8Di0t5nPjXYg6CqA="),
+		WithConnOption(amqp.ConnSASLAnonymous()),
 		WithConnOption(amqp.ConnProperty("com.microsoft:client-version", userAgent)),
 	)
 	if err != nil {
 		log.Print("connectToEventHub amqp Dial Error:", err)
 		return nil, err
 	}
-
-	// Seb
-	log.Printf("eventHub host: %s\n", host)
-	log.Printf("eventHub group: %s\n", group)
-	//log.Printf("eventHub SharedAccessKeyName: %s\n", c.sak.SharedAccessKeyName)
-	//log.Printf("eventHub SharedAccessKey: %s\n", c.sak.SharedAccessKey)
-
-	return amqpclient, nil
+	eh.tokens = NewTokenManager(ctx, eh.conn, sak)
+	if err := eh.tokens.Put(ctx, ep.audience()); err != nil {
+		eh.Close()
+		return nil, err
+	}
+	return eh, nil
 }
 
 // Option is a client configuration option.
@@ -613,9 +485,10 @@ type Option func(c *Client)
 
 // Client is an EventHub client.
 type Client struct {
-	name string
-	conn *amqp.Client
-	opts []amqp.ConnOption
+	name   string
+	conn   *amqp.Client
+	opts   []amqp.ConnOption
+	tokens *TokenManager // nil unless authorized with CBS
 }
 
 // WithTLSConfig sets connection TLS configuration.
@@ -635,26 +508,28 @@ func WithConnOption(opt amqp.ConnOption) Option {
 	}
 }
 
-// dial connects to the named EventHub and returns a client instance.
-func dial(host, name string, opts ...Option) (*amqp.Client, error) {
+// dial connects to the named EventHub at addr, amqps://host:port, and returns a client instance.
+func dial(addr, name string, opts ...Option) (*Client, error) {
 	c := &Client{name: name}
-	log.Printf("Dial options: %v\n", c)
 	for _, opt := range opts {
 		opt(c)
 	}
-	// Seb
-	log.Printf("Dial Client: %+v\n", c)
-	for _, opt := range c.opts {
-		log.Printf("Dial options: %+v\n", opt)
-	}
 
 	var err error
-	c.conn, err = amqp.Dial("amqps://"+host, c.opts...)
+	c.conn, err = amqp.Dial(addr, c.opts...)
 	if err != nil {
 		log.Print("dial Error:", err)
 		return nil, err
 	}
-	return c.conn, nil
+	return c, nil
+}
+
+// Close stops renewing the token and closes the EventHub connection.
+func (c *Client) Close() error {
+	if c.tokens != nil {
+		c.tokens.Close()
+	}
+	return c.conn.Close()
 }
 
 // fromAMQPMessage converts a amqp.Message into common.Message.
@@ -662,53 +537,100 @@ func dial(host, name string, opts ...Option) (*amqp.Client, error) {
 // Exported to use with a custom stream when devices telemetry is
 // routed for example to an EventhHub instance.
 func fromAMQPMessage(msg *amqp.Message) *Message {
+	n := len(msg.ApplicationProperties) + 5
 	m := &Message{
-		Payload:    msg.GetData(),
-		Properties: make(map[string]string, len(msg.ApplicationProperties)+5),
+		Payload:         msg.GetData(),
+		Properties:      make(map[string]string, n),
+		TypedProperties: make(map[string]*Property, n),
 	}
 	if msg.Properties != nil {
 		m.UserID = string(msg.Properties.UserID)
-		if msg.Properties.MessageID != nil {
-			m.MessageID = msg.Properties.MessageID.(string)
-		}
-		if msg.Properties.CorrelationID != nil {
-			m.CorrelationID = msg.Properties.CorrelationID.(string)
-		}
+		m.MessageID = formatMessageID(msg.Properties.MessageID)
+		m.CorrelationID = formatMessageID(msg.Properties.CorrelationID)
 		m.To = msg.Properties.To
-		m.ExpiryTime = &msg.Properties.AbsoluteExpiryTime
+		if !msg.Properties.AbsoluteExpiryTime.IsZero() {
+			t := msg.Properties.AbsoluteExpiryTime
+			m.ExpiryTime = &t
+		}
+		m.ContentType = msg.Properties.ContentType
+		m.ContentEncoding = msg.Properties.ContentEncoding
 	}
+	var ehEnqueued time.Time
 	for k, v := range msg.Annotations {
+		s, _ := v.(string)
 		switch k {
 		case "iothub-enqueuedtime":
-			t, _ := v.(time.Time)
-			m.EnqueuedTime = &t
+			if t, ok := v.(time.Time); ok {
+				m.EnqueuedTime = &t
+			}
+		case "x-opt-enqueued-time":
+			ehEnqueued, _ = v.(time.Time)
 		case "iothub-connection-device-id":
-			m.ConnectionDeviceID = v.(string)
+			m.ConnectionDeviceID = s
+		case "iothub-connection-module-id":
+			m.ConnectionModuleID = s
 		case "iothub-connection-auth-generation-id":
-			m.ConnectionDeviceGenerationID = v.(string)
+			m.ConnectionDeviceGenerationID = s
 		case "iothub-connection-auth-method":
 			var am ConnectionAuthMethod
-			if err := json.Unmarshal([]byte(v.(string)), &am); err != nil {
-				m.Properties[k.(string)] = fmt.Sprint(v)
+			if err := json.Unmarshal([]byte(s), &am); err != nil {
+				m.setProperty(fmt.Sprint(k), v)
 				continue
 			}
 			m.ConnectionAuthMethod = &am
 		case "iothub-message-source":
-			m.MessageSource = v.(string)
+			m.MessageSource = s
+		case "iothub-interface-id":
+			m.InterfaceID = s
+		case "dt-dataschema":
+			m.DataSchema = s
+		case "dt-subject":
+			m.Component = s
+		case "x-opt-sequence-number":
+			m.SequenceNumber, _ = v.(int64)
+		case "x-opt-offset":
+			m.Offset = s
+		case "x-opt-partition-key":
+			m.PartitionKey = s
 		default:
-			m.Properties[k.(string)] = fmt.Sprint(v)
+			m.setProperty(fmt.Sprint(k), v)
 		}
 	}
+	if m.EnqueuedTime == nil && !ehEnqueued.IsZero() {
+		m.EnqueuedTime = &ehEnqueued
+	}
 	for k, v := range msg.ApplicationProperties {
-		if v, ok := v.(string); ok {
-			m.Properties[k] = v
-		} else {
-			m.Properties[k] = ""
-		}
+		m.setProperty(k, v)
 	}
 	return m
 }
 
+// setProperty sets the property both as its string view and typed.
+func (m *Message) setProperty(k string, v interface{}) {
+	p := newProperty(v)
+	m.Properties[k] = p.String()
+	m.TypedProperties[k] = p
+}
+
+// formatMessageID returns the string form of a message or correlation ID,
+// which AMQP allows to be a string, uint64, UUID or binary.
+func formatMessageID(id interface{}) string {
+	switch id := id.(type) {
+	case nil:
+		return ""
+	case string:
+		return id
+	case uint64:
+		return strconv.FormatUint(id, 10)
+	case amqp.UUID:
+		return id.String()
+	case []byte:
+		return hex.EncodeToString(id)
+	default:
+		return fmt.Sprint(id)
+	}
+}
+
 func genID() string {
 	b := make([]byte, 16)
 	if _, err := rand.Read(b); err != nil {
@@ -730,81 +652,60 @@ func checkMessageResponse(msg *amqp.Message) error {
 	return fmt.Errorf("code = %d, description = %q", rc, rd)
 }
 
-// getPartitionIDs returns partition ids of the hub.
-func getPartitionIDs(ctx context.Context, sess *amqp.Session) ([]string, error) {
-	replyTo := genID()
-	recv, err := sess.NewReceiver(
-		amqp.LinkSourceAddress("$management"),
-		amqp.LinkTargetAddress(replyTo),
-	)
-	if err != nil {
-		return nil, err
-	}
-	defer recv.Close(context.Background())
+type sub struct {
+	group          string
+	start          StartPosition
+	partitionStart map[string]StartPosition
+	latestSince    time.Time
+	checkpoints    *checkpointer
+	positions      *Positions
+	workers        int
+	orderBy        string
+	buffer         int
+	lagInterval    time.Duration
+	opts           []amqp.LinkOption
+}
 
-	send, err := sess.NewSender(
-		amqp.LinkTargetAddress("$management"),
-		amqp.LinkSourceAddress(replyTo),
-	)
-	if err != nil {
-		return nil, err
-	}
-	defer send.Close(context.Background())
-
-	mid := genID()
-	if err := send.Send(ctx, &amqp.Message{
-		Properties: &amqp.MessageProperties{
-			MessageID: mid,
-			ReplyTo:   replyTo,
-		},
-		ApplicationProperties: map[string]interface{}{
-			"operation": "READ",
-			"name":      "iothub-ehub-seb-hub-8717893-e68ae183bb", //c.name
-			"type":      "com.microsoft:eventhub",
-		},
-	}); err != nil {
-		return nil, err
-	}
+// SubscribeOption is a Subscribe option.
+type SubscribeOption func(r *sub)
 
-	msg, err := recv.Receive(ctx)
-	if err != nil {
-		return nil, err
+// DefaultConsumerGroup is the consumer group every hub has.
+const DefaultConsumerGroup = "$Default"
+
+// WithSubscribeConsumerGroup reads events through the named consumer group,
+// $Default when not set. Every reader of the hub needs its own group
+// to get all events, readers of one group share them.
+func WithSubscribeConsumerGroup(name string) SubscribeOption {
+	return func(s *sub) {
+		s.group = name
 	}
-	if err = checkMessageResponse(msg); err != nil {
-		return nil, err
+}
+
+// checkConsumerGroup checks the name follows the Event Hubs rules,
+// 1 to 50 letters, digits, periods, hyphens and underscores,
+// starting and ending with a letter or digit.
+func checkConsumerGroup(name string) error {
+	if name == DefaultConsumerGroup {
+		return nil
 	}
-	if msg.Properties.CorrelationID != mid {
-		return nil, errors.New("message-id mismatch")
+	if len(name) == 0 || len(name) > 50 {
+		return errorf("bad consumer group %q, want 1 to 50 characters", name)
 	}
-	if err := msg.Accept(ctx); err != nil {
-		return nil, err
+	alnum := func(c byte) bool {
+		return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
 	}
-
-	val, ok := msg.Value.(map[string]interface{})
-	if !ok {
-		return nil, errors.New("unable to typecast value")
-	}
-	ids, ok := val["partition_ids"].([]string)
-	if !ok {
-		return nil, errors.New("unable to typecast partition_ids")
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !alnum(c) && ((i == 0 || i == len(name)-1) || c != '.' && c != '-' && c != '_') {
+			return errorf("bad consumer group %q", name)
+		}
 	}
-	return ids, nil
-}
-
-type sub struct {
-	group string
-	opts  []amqp.LinkOption
+	return nil
 }
 
-// SubscribeOption is a Subscribe option.
-type SubscribeOption func(r *sub)
-
 // WithSubscribeSince requests events that occurred after the given time.
 func WithSubscribeSince(t time.Time) SubscribeOption {
-	return WithSubscribeLinkOption(amqp.LinkSelectorFilter(
-		fmt.Sprintf("amqp.annotation.x-opt-enqueuedtimeutc > '%d'",
-			t.UnixNano()/int64(time.Millisecond)),
-	))
+	return WithSubscribeStart(StartAtTime(t))
 }
 
 // WithSubscribeLinkOption is a low-level subscription configuration option.
@@ -819,7 +720,7 @@ func WithSubscribeLinkOption(opt amqp.LinkOption) SubscribeOption {
 //
 // It's client's responsibility to accept/reject/release events.
 func subscribe(
-	c *amqp.Client,
+	c *Client,
 	ctx context.Context,
 	fn func(evtmsg *amqp.Message) error,
 	opts ...SubscribeOption,
@@ -829,17 +730,25 @@ func subscribe(
 		opt(&s)
 	}
 	if s.group == "" {
-		s.group = "$Default"
+		s.group = DefaultConsumerGroup
+	}
+	if err := checkConsumerGroup(s.group); err != nil {
+		return err
 	}
 
 	// initialize new session for each subscribe session
-	sess, err := c.NewSession()
+	sess, err := c.conn.NewSession()
 	if err != nil {
 		return err
 	}
 	defer sess.Close(context.Background())
 
-	ids, err := getPartitionIDs(ctx, sess)
+	mc, err := newManagementClient(sess)
+	if err != nil {
+		return err
+	}
+	defer mc.Close()
+	ids, err := mc.partitionIDs(ctx, c.name)
 	if err != nil {
 		return err
 	}
@@ -848,21 +757,90 @@ func subscribe(
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	msgc := make(chan *amqp.Message)
+	hub := c.name
+	var tick <-chan time.Time
+	if cp := s.checkpoints; cp != nil {
+		cp.hub, cp.group, cp.pending, cp.saved = hub, s.group, map[string]*Checkpoint{}, time.Now()
+		defer func() {
+			if err := cp.flush(); err != nil {
+				log.Printf("checkpoint error: %v\n", err)
+			}
+		}()
+		if cp.interval > 0 {
+			ticker := time.NewTicker(cp.interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+	}
+
+	if s.lagInterval > 0 {
+		lagDone := make(chan struct{})
+		go func() {
+			defer close(lagDone)
+			s.monitorLag(ctx, mc, hub, ids)
+		}()
+		// the monitor uses the management link, stopped before it's closed
+		defer func() {
+			cancel()
+			<-lagDone
+		}()
+	}
+
+	// events are committed, positions and checkpoints, in partition order
+	// once handled, whatever the worker
+	f := &inflight{parts: map[string][]*delivery{}, commit: func(d *delivery) {
+		if s.positions != nil {
+			s.positions.delivered(d.partition, d.msg)
+		}
+		if s.checkpoints != nil {
+			s.checkpoints.processed(d.partition, d.msg)
+		}
+	}}
 	errc := make(chan error)
+	workers := newPool(s.workers, s.orderBy, s.buffer)
+	workers.run(ctx, func(d *delivery) error {
+		if err := fn(d.msg); err != nil {
+			return err
+		}
+		f.done(d)
+		// saved outside the inflight lock, other workers keep committing
+		if s.checkpoints != nil && s.checkpoints.due() {
+			if err := s.checkpoints.flush(); err != nil {
+				log.Printf("checkpoint error: %v\n", err)
+			}
+		}
+		return nil
+	}, errc)
+	// let the handlers finish before the last checkpoints are saved
+	defer func() {
+		cancel()
+		workers.wait()
+	}()
 
 	for _, id := range ids {
-		addr := fmt.Sprintf("/%s/ConsumerGroups/%s/Partitions/%s", "iothub-ehub-seb-hub-8717893-e68ae183bb", s.group, id)
-		// Seb
-		//addr := fmt.Sprintf("/%s/ConsumerGroups/%s/Partitions/%s", "iothub-ehub-seb-hub-8717893-e68ae183bb", "$Default", id)
-		recv, err := sess.NewReceiver(
-			append([]amqp.LinkOption{amqp.LinkSourceAddress(addr)}, s.opts...)...,
-		)
+		// partitions without a start of their own resume after their checkpoint
+		if _, ok := s.partitionStart[id]; !ok && s.checkpoints != nil {
+			p, ok, err := s.checkpoints.start(id)
+			if err != nil {
+				return err
+			}
+			if ok {
+				WithSubscribePartitionStart(id, p)(&s)
+			}
+		}
+
+		addr := fmt.Sprintf("/%s/ConsumerGroups/%s/Partitions/%s", hub, s.group, id)
+		recv, err := sess.NewReceiver(s.linkOptions(id, addr)...)
 		if err != nil {
+			// $management reads hubs and partitions but not consumer groups,
+			// a missing group shows as the first partition link not found
+			if rerr, ok := err.(*amqp.Error); ok && rerr.Condition == amqp.ErrorNotFound {
+				return errorf("consumer group %q not found: %s", s.group, rerr.Description)
+			}
 			return err
 		}
 
-		go func(recv *amqp.Receiver) {
+		go func(id string, recv *amqp.Receiver) {
 			defer recv.Close(context.Background())
 			for {
 				msg, err := recv.Receive(ctx)
@@ -873,19 +851,21 @@ func subscribe(
 					}
 					return
 				}
+				d := &delivery{partition: id, msg: msg}
+				f.add(d)
 				select {
-				case msgc <- msg:
+				case workers.queue(d) <- d:
 				case <-ctx.Done():
 				}
 			}
-		}(recv)
+		}(id, recv)
 	}
 
 	for {
 		select {
-		case msg := <-msgc:
-			if err := fn(msg); err != nil {
-				return err
+		case <-tick:
+			if err := s.checkpoints.flush(); err != nil {
+				log.Printf("checkpoint error: %v\n", err)
 			}
 		case err := <-errc:
 			return err
@@ -895,62 +875,320 @@ func subscribe(
 	}
 }
 
-// subscribeEvents subscribes to D2C events.
+// unbatch decompresses the message payload and splits batched messages
+// into one message per document, all carrying the original properties.
+// Messages are accepted or rejected as a whole, not through the returned copies.
+func unbatch(msg *amqp.Message) ([]*amqp.Message, error) {
+	var ce string
+	if msg.Properties != nil {
+		ce = msg.Properties.ContentEncoding
+	}
+	n, batched := msg.ApplicationProperties[BatchProperty]
+	if ce != ContentEncodingGzip && ce != ContentEncodingZstd && !batched {
+		return []*amqp.Message{msg}, nil
+	}
+
+	data, err := decompress(ce, msg.GetData())
+	if err != nil {
+		return nil, err
+	}
+	frames := [][]byte{data}
+	if batched {
+		if frames, err = splitFrames(data); err != nil {
+			return nil, err
+		}
+		log.Printf("unbatched %d of %v documents\n", len(frames), n)
+	}
+
+	var props *amqp.MessageProperties
+	if msg.Properties != nil {
+		p := *msg.Properties
+		p.ContentEncoding = ""
+		props = &p
+	}
+	appProps := make(map[string]interface{}, len(msg.ApplicationProperties))
+	for k, v := range msg.ApplicationProperties {
+		if k != BatchProperty {
+			appProps[k] = v
+		}
+	}
+	msgs := make([]*amqp.Message, 0, len(frames))
+	for _, f := range frames {
+		msgs = append(msgs, &amqp.Message{
+			Header:                msg.Header,
+			DeliveryAnnotations:   msg.DeliveryAnnotations,
+			Annotations:           msg.Annotations,
+			Properties:            props,
+			ApplicationProperties: appProps,
+			Data:                  [][]byte{f},
+			Footer:                msg.Footer,
+		})
+	}
+	return msgs, nil
+}
+
+type eventsConfig struct {
+	verifier *Verifier
+	tracker  *SequenceTracker
+	subOpts  []SubscribeOption
+	endpoint *EventHubEndpoint
+	retry    *RetryPolicy
+}
+
+// EventsOption is a subscribeEvents option.
+type EventsOption func(c *eventsConfig)
+
+// WithVerifier checks signatures and decrypts payloads before events are handled.
+func WithVerifier(v *Verifier) EventsOption {
+	return func(c *eventsConfig) {
+		c.verifier = v
+	}
+}
+
+// WithSequenceTracker checks the sequence numbers of received messages.
+func WithSequenceTracker(t *SequenceTracker) EventsOption {
+	return func(c *eventsConfig) {
+		c.tracker = t
+	}
+}
+
+// WithSubscribeOptions passes subscription options, like the consumer group, on to subscribe.
+func WithSubscribeOptions(opts ...SubscribeOption) EventsOption {
+	return func(c *eventsConfig) {
+		c.subOpts = append(c.subOpts, opts...)
+	}
+}
+
+// WithEventHubEndpoint connects to the endpoint straight away,
+// skipping the redirect, e.g. with the one resolved by a previous subscription.
+func WithEventHubEndpoint(ep *EventHubEndpoint) EventsOption {
+	return func(c *eventsConfig) {
+		c.endpoint = ep
+	}
+}
+
+// subscribeEvents subscribes to D2C events of the hub connection c, authorized by sak.
 // Event handler is blocking, handle asynchronous processing on your own.
-func subscribeEvents(c *amqp.Client, ctx context.Context, fn EventHandler, tc *tls.Config) error {
+func subscribeEvents(
+	c *amqp.Client, ctx context.Context, sak *SharedAccessKey, fn EventHandler, tc *tls.Config, opts ...EventsOption,
+) error {
+	var cfg eventsConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	ep := cfg.endpoint
+	if ep == nil {
+		var err error
+		if ep, err = resolveEventHub(ctx, c, sak); err != nil {
+			log.Printf("subscribeEvents error: %v\n", err)
+			return err
+		}
+	}
+
 	// a new connection is established for every invocation,
 	// this made on purpose because normally an app calls the method once
-	eh, err := connectToEventHub(c, ctx, tc)
+	eh, err := connectToEventHub(ctx, ep, sak, tc)
 	if err != nil {
 		log.Printf("subscribeEvents error: %v\n", err)
 		return err
 	}
 	defer eh.Close()
 
-	return subscribe(eh, ctx, func(msg *amqp.Message) error {
-		//if err := fn(&Event{fromAMQPMessage(Message)}); err != nil {
-		if err := fn(msg); err != nil {
-			log.Printf("subscribeEvents subscribe error: %v\n", err)
-			return err
+	// a token that couldn't be renewed ends the subscription with its error
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var terr error
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		select {
+		case terr = <-eh.tokens.Err():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err = subscribe(eh, ctx, func(msg *amqp.Message) error {
+		if cfg.verifier != nil {
+			ok, err := cfg.verifier.check(ctx, msg)
+			if !ok {
+				return err
+			}
+		}
+		if cfg.tracker != nil {
+			cfg.tracker.Track(msg)
+		}
+		msgs, err := unbatch(msg)
+		if err != nil {
+			log.Printf("subscribeEvents unbatch error: %v\n", err)
+			msgs = []*amqp.Message{msg}
+		}
+		for _, m := range msgs {
+			e := &Event{Message: fromAMQPMessage(m), raw: m}
+			if cfg.retry != nil {
+				if err := cfg.retry.handle(ctx, fn, e); err != nil {
+					log.Printf("subscribeEvents subscribe error: %v\n", err)
+					return err
+				}
+				continue
+			}
+			if err := fn(e); err != nil {
+				log.Printf("subscribeEvents subscribe error: %v\n", err)
+				return &HandlerError{err}
+			}
 		}
 		return msg.Accept(ctx)
 	},
-		WithSubscribeSince(time.Now()),
+		append([]SubscribeOption{WithSubscribeStart(StartLatest())}, cfg.subOpts...)...,
 	)
+	cancel()
+	<-watched
+	if terr != nil {
+		return terr
+	}
+	return err
+}
 
+// decodeMessage decodes the message payload into a document according to its content type.
+func decodeMessage(schemas *SchemaRegistry, msg *Message) (map[string]interface{}, error) {
+	codec, err := schemas.CodecFor(msg.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decode(msg.Payload)
 }
 
 func main() {
-	// Create client
-	// From azure seb-hub|Settings|Shared access policies|service|Connection string-primary key
-
-	hubname := "seb-hub.azure-devices.net"
-	mytls := &tls.Config{RootCAs: rootCAs()}
-
-	client, err := amqp.Dial("amqps://"+hubname,
-		amqp.ConnTLSConfig(mytls),
-		amqp.ConnProperty("com.microsoft:client-version", userAgent),
-	)
-
+	csPtr := flag.String("cs", os.Getenv("IOTHUB_SERVICE_CONNECTION_STRING"), "service connection string, $IOTHUB_SERVICE_CONNECTION_STRING by default")
+	schemasPtr := flag.String("schemas", "", "directory of protobuf descriptor sets and avro schemas")
+	keysPtr := flag.String("keys", "", "keyring JSON file to verify signatures and decrypt payloads")
+	verifyPtr := flag.String("verify", VerifyFlag, "what to do with unverified messages, flag or reject")
+	metricsPtr := flag.String("metrics", "", "address to serve /metrics on, e.g. :9100")
+	groupPtr := flag.String("group", DefaultConsumerGroup, "consumer group, one per independent reader")
+	startPtr := flag.String("start", "latest", "start position: earliest, latest, offset:<o>, seq:<n>, RFC 3339 time or -2h")
+	partitionStart := partitionStartFlag{}
+	flag.Var(partitionStart, "partition-start", "start position of one partition, <partition>=<position>, repeatable")
+	checkpointsPtr := flag.String("checkpoints", "", "checkpoint file to resume partitions from, e.g. checkpoints.json")
+	checkpointEveryPtr := flag.Int("checkpoint-every", 100, "save checkpoints every n events, 0 to only save on time")
+	checkpointIntervalPtr := flag.Duration("checkpoint-interval", 10*time.Second, "save checkpoints this often, 0 to only save on count")
+	workersPtr := flag.Int("workers", 1, "number of concurrent event handlers")
+	orderPtr := flag.String("order", OrderByPartition, "order kept by concurrent handlers, partition or device")
+	bufferPtr := flag.Int("buffer", 16, "events queued per handler before partitions stop receiving")
+	prefetchPtr := flag.Uint("prefetch", 0, "link credit of partitions, 0 for the default")
+	retriesPtr := flag.Int("retries", 3, "handler retries before an event is dead-lettered")
+	retryBackoffPtr := flag.Duration("retry-backoff", time.Second, "wait before the first handler retry, doubled up to 30s")
+	lagIntervalPtr := flag.Duration("lag-interval", 30*time.Second, "read partition info and report lag this often with -metrics, 0 to disable")
+	deadLetterPtr := flag.String("dead-letter", "", "where to send events the handler gave up on: a directory, http(s):// URL or mqtt(s)://broker/topic, end the subscription when empty")
+	flag.Parse()
+
+	schemas, err := loadSchemaRegistry(*schemasPtr)
 	if err != nil {
-		log.Fatal("Dialing AMQP server:", err)
+		log.Fatal("Loading schemas:", err)
+	}
+	if err := checkConsumerGroup(*groupPtr); err != nil {
+		log.Fatal(err)
+	}
+	start, err := ParseStartPosition(*startPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *orderPtr != OrderByPartition && *orderPtr != OrderByDevice {
+		log.Fatalf("Unknown order %q", *orderPtr)
+	}
+	subOpts := []SubscribeOption{
+		WithSubscribeConsumerGroup(*groupPtr),
+		WithSubscribeStart(start),
+		WithSubscribeWorkers(*workersPtr, *orderPtr, *bufferPtr),
+	}
+	if *prefetchPtr > 0 {
+		subOpts = append(subOpts, WithSubscribePrefetch(uint32(*prefetchPtr)))
+	}
+	for id, p := range partitionStart {
+		subOpts = append(subOpts, WithSubscribePartitionStart(id, p))
+	}
+	var store CheckpointStore
+	if *checkpointsPtr != "" {
+		fs, err := NewFileCheckpointStore(*checkpointsPtr)
+		if err != nil {
+			log.Fatal("Loading checkpoints:", err)
+		}
+		store = fs
+		subOpts = append(subOpts, WithSubscribeCheckpoints(store, *checkpointEveryPtr, *checkpointIntervalPtr))
+	}
+	if *metricsPtr != "" && *lagIntervalPtr > 0 {
+		subOpts = append(subOpts, WithSubscribeLagInterval(*lagIntervalPtr))
+	}
+	opts := []EventsOption{
+		WithSequenceTracker(NewSequenceTracker(logSequenceEvent)),
+		WithSubscribeOptions(subOpts...),
+	}
+	if *keysPtr != "" {
+		if *verifyPtr != VerifyFlag && *verifyPtr != VerifyReject {
+			log.Fatalf("Unknown verify policy %q", *verifyPtr)
+		}
+		keys, err := loadKeyring(*keysPtr)
+		if err != nil {
+			log.Fatal("Loading keys:", err)
+		}
+		opts = append(opts, WithVerifier(&Verifier{Keys: keys, Policy: *verifyPtr}))
+	}
+	policy := &RetryPolicy{Retries: *retriesPtr, Backoff: *retryBackoffPtr, MaxBackoff: 30 * time.Second}
+	if *deadLetterPtr != "" {
+		if policy.Sink, err = ParseDeadLetterSink(*deadLetterPtr); err != nil {
+			log.Fatal("Dead-letter sink:", err)
+		}
+	}
+	opts = append(opts, WithRetryPolicy(policy))
+	if *metricsPtr != "" {
+		http.Handle("/metrics", metrics)
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsPtr, nil))
+		}()
 	}
-	defer client.Close()
 
-	log.Printf("connected to %s\n", hubname)
+	// Create client
+	if *csPtr == "" {
+		log.Fatal("No service connection string, set -cs or $IOTHUB_SERVICE_CONNECTION_STRING")
+	}
+	sak, err := parseConnectionString(*csPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mytls := &tls.Config{RootCAs: rootCAs()}
 
-	ctx := context.Background()
+	// cancel on interrupt so the last checkpoints are saved
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		cancel()
+	}()
 
-	err = subscribeEvents(client, ctx, func(msg *amqp.Message) error {
-		//fmt.Printf("%q sends %q\n", msg.ConnectionDeviceID, msg.Payload)
-		fmt.Printf("Message received: %+v\n", msg)
-		return nil
-	}, mytls)
+	// status prints the partitions and their lag instead of subscribing
+	if flag.Arg(0) == "status" {
+		if err := printStatus(ctx, sak, mytls, *groupPtr, store); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	/*
-		subscribeEvents(client, ctx, func(msg *Event) error {
-			fmt.Printf("%q sends %q\n", msg.ConnectionDeviceID, msg.Payload)
+	err = superviseEvents(ctx, sak, func(e *Event) error {
+		b, err := json.Marshal(e.Message)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Message received: %s\n", b)
+		doc, err := decodeMessage(schemas, e.Message)
+		if err != nil {
+			log.Printf("Message not decoded: %v\n", err)
 			return nil
-		})
-	*/
+		}
+		fmt.Printf("Message decoded: %v\n", doc)
+		return nil
+	}, mytls, opts...)
+	if err != nil && err != context.Canceled {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// managementClient reads event hub and partition runtime info
+// from the $management node, one request at a time.
+type managementClient struct {
+	mu      sync.Mutex
+	replyTo string
+	recv    *amqp.Receiver
+	send    *amqp.Sender
+}
+
+// newManagementClient opens the $management request and reply links on the session.
+func newManagementClient(sess *amqp.Session) (*managementClient, error) {
+	replyTo := genID()
+	recv, err := sess.NewReceiver(
+		amqp.LinkSourceAddress("$management"),
+		amqp.LinkTargetAddress(replyTo),
+	)
+	if err != nil {
+		return nil, err
+	}
+	send, err := sess.NewSender(
+		amqp.LinkTargetAddress("$management"),
+		amqp.LinkSourceAddress(replyTo),
+	)
+	if err != nil {
+		recv.Close(context.Background())
+		return nil, err
+	}
+	return &managementClient{replyTo: replyTo, recv: recv, send: send}, nil
+}
+
+// Close closes the links.
+func (mc *managementClient) Close() error {
+	err := mc.send.Close(context.Background())
+	if rerr := mc.recv.Close(context.Background()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// read reads the entity of the type, e.g. com.microsoft:eventhub,
+// props are added to the request's application properties.
+func (mc *managementClient) read(ctx context.Context, typ, name string, props map[string]interface{}) (map[string]interface{}, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mid := genID()
+	ap := map[string]interface{}{
+		"operation": "READ",
+		"name":      name,
+		"type":      typ,
+	}
+	for k, v := range props {
+		ap[k] = v
+	}
+	if err := mc.send.Send(ctx, &amqp.Message{
+		Properties: &amqp.MessageProperties{
+			MessageID: mid,
+			ReplyTo:   mc.replyTo,
+		},
+		ApplicationProperties: ap,
+	}); err != nil {
+		return nil, err
+	}
+
+	msg, err := mc.recv.Receive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkMessageResponse(msg); err != nil {
+		return nil, err
+	}
+	if msg.Properties.CorrelationID != mid {
+		return nil, errors.New("message-id mismatch")
+	}
+	if err := msg.Accept(ctx); err != nil {
+		return nil, err
+	}
+
+	val, ok := msg.Value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("unable to typecast value")
+	}
+	return val, nil
+}
+
+// partitionIDs returns partition ids of the hub.
+func (mc *managementClient) partitionIDs(ctx context.Context, name string) ([]string, error) {
+	val, err := mc.read(ctx, "com.microsoft:eventhub", name, nil)
+	if err != nil {
+		return nil, err
+	}
+	ids, ok := val["partition_ids"].([]string)
+	if !ok {
+		return nil, errors.New("unable to typecast partition_ids")
+	}
+	return ids, nil
+}
+
+// PartitionInfo is the runtime info of a partition.
+type PartitionInfo struct {
+	ID                         string
+	BeginSequenceNumber        int64
+	LastEnqueuedSequenceNumber int64
+	LastEnqueuedOffset         string
+	LastEnqueuedTime           time.Time
+	Empty                      bool
+}
+
+// partitionInfo returns the runtime info of a partition of the hub.
+func (mc *managementClient) partitionInfo(ctx context.Context, name, id string) (*PartitionInfo, error) {
+	val, err := mc.read(ctx, "com.microsoft:partition", name, map[string]interface{}{
+		"partition": id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	info := &PartitionInfo{ID: id}
+	info.BeginSequenceNumber, _ = val["begin_sequence_number"].(int64)
+	info.LastEnqueuedSequenceNumber, _ = val["last_enqueued_sequence_number"].(int64)
+	info.LastEnqueuedOffset, _ = val["last_enqueued_offset"].(string)
+	info.LastEnqueuedTime, _ = val["last_enqueued_time_utc"].(time.Time)
+	info.Empty, _ = val["is_partition_empty"].(bool)
+	return info, nil
+}
+
+// lag returns the number of events enqueued after the checkpoint,
+// all the events of the partition without one.
+func (info *PartitionInfo) lag(cp *Checkpoint) int64 {
+	if info.Empty {
+		return 0
+	}
+	if cp == nil {
+		return info.LastEnqueuedSequenceNumber - info.BeginSequenceNumber + 1
+	}
+	if n := info.LastEnqueuedSequenceNumber - cp.SequenceNumber; n > 0 {
+		return n
+	}
+	return 0
+}
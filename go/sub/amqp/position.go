@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// StartPosition is where in a partition's retained events a subscription starts,
+// it becomes the selector filter of the partition link.
+type StartPosition struct {
+	filter string
+}
+
+// StartEarliest starts at the oldest event the hub retains.
+func StartEarliest() StartPosition {
+	return StartPosition{"amqp.annotation.x-opt-offset > '-1'"}
+}
+
+// StartLatest starts with the events enqueued from now on.
+func StartLatest() StartPosition {
+	return StartPosition{"amqp.annotation.x-opt-offset > '@latest'"}
+}
+
+// StartAtOffset starts after the event at the offset, or at it when inclusive.
+func StartAtOffset(offset string, inclusive bool) StartPosition {
+	return StartPosition{fmt.Sprintf("amqp.annotation.x-opt-offset %s '%s'", op(inclusive), offset)}
+}
+
+// StartAtSequenceNumber starts after the event with the sequence number,
+// or at it when inclusive.
+func StartAtSequenceNumber(seq int64, inclusive bool) StartPosition {
+	return StartPosition{fmt.Sprintf("amqp.annotation.x-opt-sequence-number %s '%d'", op(inclusive), seq)}
+}
+
+// StartAtTime starts with the events enqueued after t.
+func StartAtTime(t time.Time) StartPosition {
+	return StartPosition{fmt.Sprintf("amqp.annotation.x-opt-enqueuedtimeutc > '%d'",
+		t.UnixNano()/int64(time.Millisecond))}
+}
+
+func op(inclusive bool) string {
+	if inclusive {
+		return ">="
+	}
+	return ">"
+}
+
+// String returns the selector filter of the position.
+func (p StartPosition) String() string {
+	return p.filter
+}
+
+// WithSubscribeStart starts all partitions at the position,
+// unless set for a partition with WithSubscribePartitionStart.
+func WithSubscribeStart(p StartPosition) SubscribeOption {
+	return func(s *sub) {
+		s.start = p
+	}
+}
+
+// WithSubscribePartitionStart starts the partition of the given ID at the position.
+func WithSubscribePartitionStart(partition string, p StartPosition) SubscribeOption {
+	return func(s *sub) {
+		if s.partitionStart == nil {
+			s.partitionStart = map[string]StartPosition{}
+		}
+		s.partitionStart[partition] = p
+	}
+}
+
+// withSubscribeLatestSince pins the latest position to the time,
+// so partitions resubscribed after a reconnect don't skip events.
+func withSubscribeLatestSince(t time.Time) SubscribeOption {
+	return func(s *sub) {
+		s.latestSince = t
+	}
+}
+
+// startPosition returns the start position of a partition.
+func (s *sub) startPosition(partition string) StartPosition {
+	p, ok := s.partitionStart[partition]
+	if !ok {
+		p = s.start
+	}
+	if p == StartLatest() && !s.latestSince.IsZero() {
+		p = StartAtTime(s.latestSince)
+	}
+	return p
+}
+
+// linkOptions returns the link options of a partition, its start position first.
+func (s *sub) linkOptions(partition, addr string) []amqp.LinkOption {
+	p := s.startPosition(partition)
+	opts := []amqp.LinkOption{amqp.LinkSourceAddress(addr)}
+	if p.filter != "" {
+		opts = append(opts, amqp.LinkSelectorFilter(p.filter))
+	}
+	return append(opts, s.opts...)
+}
+
+// ParseStartPosition parses a start position from the command line:
+//
+//	earliest, latest
+//	offset:<offset>   after the offset, offset=<offset> at it
+//	seq:<number>      after the sequence number, seq=<number> at it
+//	2021-04-05T14:00:00Z or -2h, enqueued after the time or that long ago
+func ParseStartPosition(s string) (StartPosition, error) {
+	switch s {
+	case "earliest":
+		return StartEarliest(), nil
+	case "latest":
+		return StartLatest(), nil
+	}
+	for _, kind := range []string{"offset", "seq"} {
+		if !strings.HasPrefix(s, kind) || len(s) < len(kind)+2 {
+			continue
+		}
+		sep, v := s[len(kind)], s[len(kind)+1:]
+		if sep != ':' && sep != '=' {
+			break
+		}
+		if kind == "offset" {
+			// offsets are numbers, kept as strings, checked as they go in a filter
+			if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+				return StartPosition{}, errorf("bad offset %q", v)
+			}
+			return StartAtOffset(v, sep == '='), nil
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return StartPosition{}, errorf("bad sequence number %q", v)
+		}
+		return StartAtSequenceNumber(n, sep == '='), nil
+	}
+	if strings.HasPrefix(s, "-") {
+		d, err := time.ParseDuration(s[1:])
+		if err != nil {
+			return StartPosition{}, errorf("bad start position %q: %v", s, err)
+		}
+		return StartAtTime(time.Now().Add(-d)), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return StartPosition{}, errorf("bad start position %q", s)
+	}
+	return StartAtTime(t), nil
+}
+
+// partitionStartFlag is a repeatable -partition-start <partition>=<position> flag.
+type partitionStartFlag map[string]StartPosition
+
+func (f partitionStartFlag) String() string {
+	return fmt.Sprint(map[string]StartPosition(f))
+}
+
+func (f partitionStartFlag) Set(v string) error {
+	i := strings.IndexByte(v, '=')
+	if i <= 0 {
+		return errorf("want <partition>=<position>, got %q", v)
+	}
+	p, err := ParseStartPosition(v[i+1:])
+	if err != nil {
+		return err
+	}
+	f[v[:i]] = p
+	return nil
+}
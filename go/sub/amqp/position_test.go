@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseStartPosition(t *testing.T) {
+	tests := []struct {
+		in     string
+		filter string
+	}{
+		{"earliest", "amqp.annotation.x-opt-offset > '-1'"},
+		{"latest", "amqp.annotation.x-opt-offset > '@latest'"},
+		{"offset:4294967296", "amqp.annotation.x-opt-offset > '4294967296'"},
+		{"offset=4294967296", "amqp.annotation.x-opt-offset >= '4294967296'"},
+		{"seq:1200", "amqp.annotation.x-opt-sequence-number > '1200'"},
+		{"seq=1200", "amqp.annotation.x-opt-sequence-number >= '1200'"},
+		{"2021-04-05T14:00:00Z", "amqp.annotation.x-opt-enqueuedtimeutc > '1617631200000'"},
+		{"2021-04-05T22:00:00+08:00", "amqp.annotation.x-opt-enqueuedtimeutc > '1617631200000'"},
+	}
+	for _, tt := range tests {
+		p, err := ParseStartPosition(tt.in)
+		if err != nil {
+			t.Errorf("ParseStartPosition(%q): %v", tt.in, err)
+			continue
+		}
+		if p.String() != tt.filter {
+			t.Errorf("ParseStartPosition(%q) = %s, want %s", tt.in, p, tt.filter)
+		}
+	}
+
+	before := time.Now().Add(-2 * time.Hour)
+	p, err := ParseStartPosition("-2h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().Add(-2 * time.Hour)
+	var ms int64
+	if _, err := fmt.Sscanf(p.String(), "amqp.annotation.x-opt-enqueuedtimeutc > '%d'", &ms); err != nil {
+		t.Fatalf("ParseStartPosition(-2h) = %s: %v", p, err)
+	}
+	if ms < before.UnixNano()/1e6 || ms > after.UnixNano()/1e6 {
+		t.Fatalf("ParseStartPosition(-2h) = %s, want 2 hours ago", p)
+	}
+
+	for _, in := range []string{
+		"", "oldest", "offset", "offset:", "offset-12", "offset:12' OR '1'='1", "offset:abc",
+		"seq:", "seq:x", "seq=1.5", "-2", "-two hours", "2021-04-05", "yesterday",
+	} {
+		if p, err := ParseStartPosition(in); err == nil {
+			t.Errorf("ParseStartPosition(%q) = %s, want an error", in, p)
+		}
+	}
+}
+
+func TestPartitionStartFlag(t *testing.T) {
+	f := partitionStartFlag{}
+	for _, v := range []string{"0=earliest", "3=seq:42", "0=offset:100"} {
+		if err := f.Set(v); err != nil {
+			t.Fatalf("Set(%q): %v", v, err)
+		}
+	}
+	if len(f) != 2 || f["0"] != StartAtOffset("100", false) || f["3"] != StartAtSequenceNumber(42, false) {
+		t.Fatalf("flag = %v", f)
+	}
+	for _, v := range []string{"earliest", "=earliest", "1=", "1=soon"} {
+		if err := f.Set(v); err == nil {
+			t.Errorf("Set(%q): want an error", v)
+		}
+	}
+}
+
+func TestSubStartPosition(t *testing.T) {
+	since := time.Date(2021, 4, 5, 14, 0, 0, 0, time.UTC)
+	s := &sub{}
+	for _, opt := range []SubscribeOption{
+		WithSubscribeStart(StartLatest()),
+		WithSubscribePartitionStart("1", StartEarliest()),
+		WithSubscribePartitionStart("2", StartAtSequenceNumber(7, true)),
+	} {
+		opt(s)
+	}
+	for partition, want := range map[string]StartPosition{
+		"0": StartLatest(),
+		"1": StartEarliest(),
+		"2": StartAtSequenceNumber(7, true),
+	} {
+		if p := s.startPosition(partition); p != want {
+			t.Errorf("partition %s starts at %s, want %s", partition, p, want)
+		}
+	}
+
+	// after a reconnect, latest is pinned to when the subscription started
+	withSubscribeLatestSince(since)(s)
+	if p := s.startPosition("0"); p != StartAtTime(since) {
+		t.Fatalf("partition 0 starts at %s, want %s", p, StartAtTime(since))
+	}
+	if p := s.startPosition("1"); p != StartEarliest() {
+		t.Fatalf("partition 1 starts at %s, want earliest", p)
+	}
+	if p := StartAtTime(since); p.String() != "amqp.annotation.x-opt-enqueuedtimeutc > '"+strconv.FormatInt(since.Unix()*1000, 10)+"'" {
+		t.Fatalf("StartAtTime = %s", p)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// Property types, named after the Go types of the values.
+const (
+	PropString  = "string"
+	PropBool    = "bool"
+	PropInt8    = "int8"
+	PropInt16   = "int16"
+	PropInt32   = "int32"
+	PropInt64   = "int64"
+	PropUint8   = "uint8"
+	PropUint16  = "uint16"
+	PropUint32  = "uint32"
+	PropUint64  = "uint64"
+	PropFloat32 = "float32"
+	PropFloat64 = "float64"
+	PropTime    = "time"   // time.Time
+	PropUUID    = "uuid"   // amqp.UUID
+	PropBinary  = "binary" // []byte
+	PropNull    = "null"
+)
+
+// Property is a message property or annotation with its AMQP type kept,
+// its JSON form is {"type": "int32", "value": 3} so it round-trips.
+// Values of other types, like lists and maps, are kept as their string form.
+type Property struct {
+	Type  string
+	Value interface{}
+}
+
+// newProperty returns the typed property of an AMQP value.
+func newProperty(v interface{}) *Property {
+	switch v := v.(type) {
+	case nil:
+		return &Property{PropNull, nil}
+	case string:
+		return &Property{PropString, v}
+	case bool:
+		return &Property{PropBool, v}
+	case int8:
+		return &Property{PropInt8, v}
+	case int16:
+		return &Property{PropInt16, v}
+	case int32:
+		return &Property{PropInt32, v}
+	case int64:
+		return &Property{PropInt64, v}
+	case int:
+		return &Property{PropInt64, int64(v)}
+	case uint8:
+		return &Property{PropUint8, v}
+	case uint16:
+		return &Property{PropUint16, v}
+	case uint32:
+		return &Property{PropUint32, v}
+	case uint64:
+		return &Property{PropUint64, v}
+	case float32:
+		return &Property{PropFloat32, v}
+	case float64:
+		return &Property{PropFloat64, v}
+	case time.Time:
+		return &Property{PropTime, v}
+	case amqp.UUID:
+		return &Property{PropUUID, v}
+	case []byte:
+		return &Property{PropBinary, v}
+	default:
+		return &Property{PropString, fmt.Sprint(v)}
+	}
+}
+
+// String returns the string view of the value, binary values in hex.
+func (p *Property) String() string {
+	switch v := p.Value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []byte:
+		return hex.EncodeToString(v)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+type jsonProperty struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p *Property) MarshalJSON() ([]byte, error) {
+	var v interface{}
+	switch pv := p.Value.(type) {
+	case nil:
+		return json.Marshal(&jsonProperty{Type: p.Type})
+	case time.Time:
+		v = pv.Format(time.RFC3339Nano)
+	case amqp.UUID:
+		v = pv.String()
+	case []byte:
+		v = base64.StdEncoding.EncodeToString(pv)
+	case int64, uint64:
+		v = fmt.Sprint(pv) // beyond float64 precision
+	default:
+		v = pv
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&jsonProperty{Type: p.Type, Value: b})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *Property) UnmarshalJSON(b []byte) error {
+	var jp jsonProperty
+	if err := json.Unmarshal(b, &jp); err != nil {
+		return err
+	}
+	p.Type = jp.Type
+	if jp.Type == PropNull {
+		p.Value = nil
+		return nil
+	}
+
+	var s string
+	var num json.Number
+	switch jp.Type {
+	case PropBool:
+		var v bool
+		err := json.Unmarshal(jp.Value, &v)
+		p.Value = v
+		return err
+	case PropString, PropTime, PropUUID, PropBinary, PropInt64, PropUint64:
+		if err := json.Unmarshal(jp.Value, &s); err != nil {
+			return err
+		}
+	default:
+		if err := json.Unmarshal(jp.Value, &num); err != nil {
+			return err
+		}
+		s = num.String()
+	}
+
+	var err error
+	switch jp.Type {
+	case PropString:
+		p.Value = s
+	case PropTime:
+		p.Value, err = time.Parse(time.RFC3339Nano, s)
+	case PropUUID:
+		p.Value, err = parseUUID(s)
+	case PropBinary:
+		p.Value, err = base64.StdEncoding.DecodeString(s)
+	case PropInt8, PropInt16, PropInt32, PropInt64:
+		var n int64
+		if n, err = strconv.ParseInt(s, 10, bitSize(jp.Type)); err == nil {
+			p.Value = n
+			switch jp.Type {
+			case PropInt8:
+				p.Value = int8(n)
+			case PropInt16:
+				p.Value = int16(n)
+			case PropInt32:
+				p.Value = int32(n)
+			}
+		}
+	case PropUint8, PropUint16, PropUint32, PropUint64:
+		var n uint64
+		if n, err = strconv.ParseUint(s, 10, bitSize(jp.Type)); err == nil {
+			p.Value = n
+			switch jp.Type {
+			case PropUint8:
+				p.Value = uint8(n)
+			case PropUint16:
+				p.Value = uint16(n)
+			case PropUint32:
+				p.Value = uint32(n)
+			}
+		}
+	case PropFloat32:
+		var f float64
+		f, err = strconv.ParseFloat(s, 32)
+		p.Value = float32(f)
+	case PropFloat64:
+		p.Value, err = strconv.ParseFloat(s, 64)
+	default:
+		return errorf("unknown property type %q", jp.Type)
+	}
+	return err
+}
+
+func bitSize(typ string) int {
+	switch typ {
+	case PropInt8, PropUint8:
+		return 8
+	case PropInt16, PropUint16:
+		return 16
+	case PropInt32, PropUint32:
+		return 32
+	}
+	return 64
+}
+
+// parseUUID parses the 8-4-4-4-12 hex form of a UUID.
+func parseUUID(s string) (amqp.UUID, error) {
+	var u amqp.UUID
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return u, errorf("bad UUID %q", s)
+	}
+	h := s[0:8] + s[9:13] + s[14:18] + s[19:23] + s[24:]
+	if _, err := hex.Decode(u[:], []byte(h)); err != nil {
+		return u, errorf("bad UUID %q", s)
+	}
+	return u, nil
+}
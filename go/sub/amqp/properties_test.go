@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+func TestPropertyJSON(t *testing.T) {
+	when := time.Date(2021, 4, 12, 8, 30, 15, 123456789, time.UTC)
+	uuid := amqp.UUID{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	tests := []struct {
+		value interface{}
+		typ   string
+		json  string
+		str   string
+	}{
+		{nil, PropNull, `{"type":"null"}`, ""},
+		{"hello", PropString, `{"type":"string","value":"hello"}`, "hello"},
+		{true, PropBool, `{"type":"bool","value":true}`, "true"},
+		{int8(-128), PropInt8, `{"type":"int8","value":-128}`, "-128"},
+		{int16(math.MaxInt16), PropInt16, `{"type":"int16","value":32767}`, "32767"},
+		{int32(math.MinInt32), PropInt32, `{"type":"int32","value":-2147483648}`, "-2147483648"},
+		{int64(1<<53 + 1), PropInt64, `{"type":"int64","value":"9007199254740993"}`, "9007199254740993"},
+		{int64(math.MinInt64), PropInt64, `{"type":"int64","value":"-9223372036854775808"}`, "-9223372036854775808"},
+		{uint8(255), PropUint8, `{"type":"uint8","value":255}`, "255"},
+		{uint16(65535), PropUint16, `{"type":"uint16","value":65535}`, "65535"},
+		{uint32(math.MaxUint32), PropUint32, `{"type":"uint32","value":4294967295}`, "4294967295"},
+		{uint64(math.MaxUint64), PropUint64, `{"type":"uint64","value":"18446744073709551615"}`, "18446744073709551615"},
+		{float32(0.1), PropFloat32, `{"type":"float32","value":0.1}`, "0.1"},
+		{1e300, PropFloat64, `{"type":"float64","value":1e+300}`, "1e+300"},
+		{when, PropTime, `{"type":"time","value":"2021-04-12T08:30:15.123456789Z"}`, "2021-04-12T08:30:15.123456789Z"},
+		{uuid, PropUUID, `{"type":"uuid","value":"12345678-9abc-def0-0123-456789abcdef"}`, "12345678-9abc-def0-0123-456789abcdef"},
+		{[]byte{0, 1, 0xfe, 0xff}, PropBinary, `{"type":"binary","value":"AAH+/w=="}`, "0001feff"},
+		{[]byte{}, PropBinary, `{"type":"binary","value":""}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ, func(t *testing.T) {
+			p := newProperty(tt.value)
+			if p.Type != tt.typ {
+				t.Fatalf("newProperty(%v).Type = %q, want %q", tt.value, p.Type, tt.typ)
+			}
+			if s := p.String(); s != tt.str {
+				t.Fatalf("String = %q, want %q", s, tt.str)
+			}
+			b, err := json.Marshal(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.json {
+				t.Fatalf("MarshalJSON = %s, want %s", b, tt.json)
+			}
+			var got Property
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Type != tt.typ || !reflect.DeepEqual(got.Value, tt.value) {
+				t.Fatalf("UnmarshalJSON = %T %v, want %T %v", got.Value, got.Value, tt.value, tt.value)
+			}
+		})
+	}
+}
+
+func TestPropertyFromAMQP(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		typ   string
+		want  interface{}
+	}{
+		{int(7), PropInt64, int64(7)},
+		{struct{ A, B int }{1, 2}, PropString, "{1 2}"},
+		{[]interface{}{"a", int32(1)}, PropString, "[a 1]"},
+	}
+	for _, tt := range tests {
+		p := newProperty(tt.value)
+		if p.Type != tt.typ || !reflect.DeepEqual(p.Value, tt.want) {
+			t.Errorf("newProperty(%#v) = %s %#v, want %s %#v", tt.value, p.Type, p.Value, tt.typ, tt.want)
+		}
+	}
+}
+
+func TestPropertyUnmarshalErrors(t *testing.T) {
+	for _, b := range []string{
+		`{"type":"int8","value":128}`,
+		`{"type":"uint8","value":-1}`,
+		`{"type":"int64","value":9007199254740993}`, // 64-bit integers are strings
+		`{"type":"uint64","value":"18446744073709551616"}`,
+		`{"type":"int32","value":1.5}`,
+		`{"type":"bool","value":"true"}`,
+		`{"type":"time","value":"yesterday"}`,
+		`{"type":"uuid","value":"12345678-9abc-def0-0123-456789abcdeg"}`,
+		`{"type":"uuid","value":"123456789abcdef00123456789abcdef"}`,
+		`{"type":"binary","value":"not base64!"}`,
+		`{"type":"decimal128","value":"1"}`,
+	} {
+		var p Property
+		if err := json.Unmarshal([]byte(b), &p); err == nil {
+			t.Errorf("UnmarshalJSON(%s) = %T %v, want an error", b, p.Value, p.Value)
+		}
+	}
+}
+
+func TestMessagePropertiesJSON(t *testing.T) {
+	in := map[string]*Property{
+		"count": newProperty(uint64(1<<63 + 5)),
+		"at":    newProperty(time.Date(2021, 4, 12, 8, 0, 0, 0, time.UTC)),
+		"ok":    newProperty(false),
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]*Property
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Fatalf("round trip of %s = %v, want %v", b, out, in)
+	}
+}
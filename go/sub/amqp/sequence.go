@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/Azure/go-amqp"
+)
+
+// Message properties stamped by the publisher on every message.
+const (
+	PropSeq    = "seq"
+	PropBootID = "boot-id"
+)
+
+// Sequence anomaly kinds.
+const (
+	SequenceGap       = "gap"       // messages were skipped
+	SequenceDuplicate = "duplicate" // a message was seen before
+	SequenceReorder   = "reorder"   // a skipped message arrived late
+	SequenceReboot    = "reboot"    // the device restarted, the boot ID changed
+	SequenceReset     = "reset"     // the device restarted and lost its sequence
+)
+
+// maxMissing bounds the skipped sequence numbers kept per device to tell reorders from duplicates.
+const maxMissing = 1024
+
+// SequenceEvent reports an anomaly in a device's message sequence.
+type SequenceEvent struct {
+	Kind     string
+	DeviceID string
+	BootID   string
+
+	// Expected is the sequence number expected next, Got the one received.
+	Expected uint64
+	Got      uint64
+}
+
+// SequenceHandler handles sequence anomalies.
+type SequenceHandler func(e *SequenceEvent)
+
+type deviceSequence struct {
+	bootID  string
+	next    uint64
+	missing map[uint64]bool
+}
+
+// SequenceTracker tracks sequence numbers per device, reporting gaps,
+// duplicates and reorders to its handler and in metrics.
+type SequenceTracker struct {
+	mu      sync.Mutex
+	fn      SequenceHandler
+	devices map[string]*deviceSequence
+}
+
+func init() {
+	metrics.Help("amqpsub_sequence_anomalies_total", "Sequence anomalies per device and kind.")
+	metrics.Help("amqpsub_sequence_missing_total", "Messages skipped in device sequences.")
+}
+
+// NewSequenceTracker returns a tracker calling fn on every anomaly, fn may be nil.
+func NewSequenceTracker(fn SequenceHandler) *SequenceTracker {
+	return &SequenceTracker{fn: fn, devices: map[string]*deviceSequence{}}
+}
+
+// Track checks the sequence number of the message,
+// messages without one are ignored.
+func (t *SequenceTracker) Track(msg *amqp.Message) {
+	deviceID, _ := msg.Annotations["iothub-connection-device-id"].(string)
+	s, _ := msg.ApplicationProperties[PropSeq].(string)
+	bootID, _ := msg.ApplicationProperties[PropBootID].(string)
+	seq, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.devices[deviceID]
+	if !ok {
+		t.devices[deviceID] = &deviceSequence{
+			bootID:  bootID,
+			next:    seq + 1,
+			missing: map[uint64]bool{},
+		}
+		return
+	}
+
+	// a new boot starts a new sequence, the publisher skips the rest
+	// of the block it reserved before restarting, that's no gap
+	if bootID != d.bootID {
+		d.bootID = bootID
+		if seq < d.next {
+			t.report(SequenceReset, deviceID, bootID, d.next, seq)
+		} else {
+			t.report(SequenceReboot, deviceID, bootID, d.next, seq)
+		}
+		d.next, d.missing = seq+1, map[uint64]bool{}
+		return
+	}
+
+	switch {
+	case seq == d.next:
+		d.next++
+	case seq > d.next:
+		metrics.Add("amqpsub_sequence_missing_total", float64(seq-d.next), "device", deviceID)
+		t.report(SequenceGap, deviceID, bootID, d.next, seq)
+		for n := d.next; n < seq && len(d.missing) < maxMissing; n++ {
+			d.missing[n] = true
+		}
+		d.next = seq + 1
+	case d.missing[seq]:
+		delete(d.missing, seq)
+		t.report(SequenceReorder, deviceID, bootID, d.next, seq)
+	default:
+		t.report(SequenceDuplicate, deviceID, bootID, d.next, seq)
+	}
+}
+
+func (t *SequenceTracker) report(kind, deviceID, bootID string, expected, got uint64) {
+	metrics.Inc("amqpsub_sequence_anomalies_total", "device", deviceID, "kind", kind)
+	if t.fn == nil {
+		return
+	}
+	t.fn(&SequenceEvent{
+		Kind:     kind,
+		DeviceID: deviceID,
+		BootID:   bootID,
+		Expected: expected,
+		Got:      got,
+	})
+}
+
+// logSequenceEvent is a SequenceHandler that logs anomalies.
+func logSequenceEvent(e *SequenceEvent) {
+	log.Printf("sequence %s from %q boot %s: expected %d, got %d\n",
+		e.Kind, e.DeviceID, e.BootID, e.Expected, e.Got)
+}
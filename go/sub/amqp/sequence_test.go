@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+)
+
+func seqMessage(deviceID, bootID string, seq uint64) *amqp.Message {
+	return &amqp.Message{
+		Annotations: amqp.Annotations{"iothub-connection-device-id": deviceID},
+		ApplicationProperties: map[string]interface{}{
+			PropSeq:    strconv.FormatUint(seq, 10),
+			PropBootID: bootID,
+		},
+	}
+}
+
+// counter returns the value of the named metric with the labels.
+func counter(name string, labels ...string) float64 {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	return metrics.counters[name][labelString(labels)]
+}
+
+func TestSequenceTracker(t *testing.T) {
+	type msg struct {
+		boot string
+		seq  uint64
+	}
+	tests := []struct {
+		name    string
+		msgs    []msg
+		kinds   []string
+		missing float64
+	}{
+		{"in order", []msg{{"a", 1}, {"a", 2}, {"a", 3}}, nil, 0},
+		{"gap", []msg{{"a", 1}, {"a", 4}, {"a", 5}}, []string{SequenceGap}, 2},
+		{"reorder", []msg{{"a", 1}, {"a", 3}, {"a", 2}, {"a", 4}}, []string{SequenceGap, SequenceReorder}, 1},
+		{"duplicate", []msg{{"a", 1}, {"a", 2}, {"a", 2}, {"a", 3}}, []string{SequenceDuplicate}, 0},
+		{"late duplicate", []msg{{"a", 1}, {"a", 3}, {"a", 2}, {"a", 2}}, []string{SequenceGap, SequenceReorder, SequenceDuplicate}, 1},
+		// the publisher skips the rest of its reserved block on restart
+		{"reboot", []msg{{"a", 1}, {"a", 2}, {"b", 1000}, {"b", 1001}}, []string{SequenceReboot}, 0},
+		{"reset", []msg{{"a", 5}, {"a", 6}, {"b", 1}, {"b", 2}}, []string{SequenceReset}, 0},
+		{"gap after reboot", []msg{{"a", 1}, {"b", 1000}, {"b", 1002}}, []string{SequenceReboot, SequenceGap}, 1},
+		{"old boot after reboot", []msg{{"a", 1}, {"b", 1000}, {"b", 1000}}, []string{SequenceReboot, SequenceDuplicate}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deviceID := "seq-" + tt.name
+			var kinds []string
+			tr := NewSequenceTracker(func(e *SequenceEvent) {
+				if e.DeviceID != deviceID {
+					t.Errorf("event of %q, want %q", e.DeviceID, deviceID)
+				}
+				kinds = append(kinds, e.Kind)
+			})
+			for _, m := range tt.msgs {
+				tr.Track(seqMessage(deviceID, m.boot, m.seq))
+			}
+			if len(kinds) != len(tt.kinds) {
+				t.Fatalf("events = %v, want %v", kinds, tt.kinds)
+			}
+			for i := range kinds {
+				if kinds[i] != tt.kinds[i] {
+					t.Fatalf("events = %v, want %v", kinds, tt.kinds)
+				}
+			}
+			if n := counter("amqpsub_sequence_missing_total", "device", deviceID); n != tt.missing {
+				t.Fatalf("missing = %v, want %v", n, tt.missing)
+			}
+		})
+	}
+}
+
+func TestSequenceTrackerIgnoresUnsequenced(t *testing.T) {
+	called := false
+	tr := NewSequenceTracker(func(e *SequenceEvent) { called = true })
+	msg := seqMessage("seq-none", "a", 1)
+	delete(msg.ApplicationProperties, PropSeq)
+	tr.Track(msg)
+	tr.Track(seqMessage("seq-none", "a", 5))
+	tr.Track(seqMessage("seq-none", "a", 6))
+	if called {
+		t.Fatal("anomaly reported for a message without a sequence number")
+	}
+}
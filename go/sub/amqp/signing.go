@@ -0,0 +1,323 @@
+package main
+
+// This file is shared with azure-iot-sdk/sebEdgeGoMqttPub/modules/GoMqttPubModuleArm32v7/signing.go,
+// keep both copies in sync.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// Message properties of signed and encrypted payloads.
+const (
+	PropSigAlg = "sig-alg"
+	PropSigKid = "sig-kid"
+	PropSig    = "sig"
+	PropEncAlg = "enc-alg"
+	PropEncKid = "enc-kid"
+
+	// PropSigProps lists the application properties covered by the signature.
+	PropSigProps = "sig-props"
+)
+
+// mustSign are the properties a verified message may only carry signed,
+// so a captured message can't be replayed with another sequence number,
+// or have its payload read differently.
+var mustSign = []string{PropSeq, PropBootID, BatchProperty, PropEncAlg, PropEncKid}
+
+// Key types and the algorithms they're used with.
+const (
+	KeyHMAC    = "hmac"    // hmac-sha256
+	KeyEd25519 = "ed25519" // ed25519
+	KeyAES     = "aes"     // aes-256-gcm
+
+	AlgHMAC      = "hmac-sha256"
+	AlgEd25519   = "ed25519"
+	AlgAES256GCM = "aes-256-gcm"
+)
+
+// Key is a signing or encryption key, Key holds the base64 HMAC secret,
+// AES key or Ed25519 private key (or seed), Public the Ed25519 public key
+// which is all the verifying side needs.
+type Key struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Key    string `json:"key,omitempty"`
+	Public string `json:"public,omitempty"`
+
+	secret []byte
+	priv   ed25519.PrivateKey
+	pub    ed25519.PublicKey
+}
+
+// Keyring holds keys by their ID, several keys of a type
+// can be in use at once while they're being rotated.
+//
+// Example keys.json:
+//
+//	{"keys": [
+//	  {"id": "hmac-2021-04", "type": "hmac", "key": "c2VjcmV0..."},
+//	  {"id": "ed-2021-04", "type": "ed25519", "public": "MCowBQ..."},
+//	  {"id": "aes-2021-04", "type": "aes", "key": "q83vEj..."}
+//	]}
+type Keyring struct {
+	keys map[string]*Key
+}
+
+// loadKeyring reads and decodes the keyring file.
+func loadKeyring(name string) (*Keyring, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Keys []*Key `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+	kr := &Keyring{keys: make(map[string]*Key, len(file.Keys))}
+	for _, k := range file.Keys {
+		if err := k.decode(); err != nil {
+			return nil, fmt.Errorf("keys: key %q: %v", k.ID, err)
+		}
+		kr.keys[k.ID] = k
+	}
+	return kr, nil
+}
+
+func (k *Key) decode() error {
+	var err error
+	if k.Key != "" {
+		if k.secret, err = base64.StdEncoding.DecodeString(k.Key); err != nil {
+			return err
+		}
+	}
+	switch k.Type {
+	case KeyHMAC:
+		if len(k.secret) == 0 {
+			return errors.New("hmac key is empty")
+		}
+	case KeyAES:
+		if len(k.secret) != 32 {
+			return errors.New("aes key must be 32 bytes")
+		}
+	case KeyEd25519:
+		switch len(k.secret) {
+		case 0:
+		case ed25519.SeedSize:
+			k.priv = ed25519.NewKeyFromSeed(k.secret)
+		case ed25519.PrivateKeySize:
+			k.priv = ed25519.PrivateKey(k.secret)
+		default:
+			return errors.New("bad ed25519 private key size")
+		}
+		if k.Public != "" {
+			b, err := base64.StdEncoding.DecodeString(k.Public)
+			if err != nil {
+				return err
+			}
+			if len(b) != ed25519.PublicKeySize {
+				return errors.New("bad ed25519 public key size")
+			}
+			k.pub = ed25519.PublicKey(b)
+		} else if k.priv != nil {
+			k.pub = k.priv.Public().(ed25519.PublicKey)
+		} else {
+			return errors.New("ed25519 key needs a private or public key")
+		}
+	default:
+		return fmt.Errorf("unknown key type %q", k.Type)
+	}
+	return nil
+}
+
+// Lookup returns the key of the given ID and type.
+func (kr *Keyring) Lookup(kid, typ string) (*Key, error) {
+	if kr == nil {
+		return nil, errors.New("keys: no keyring")
+	}
+	k, ok := kr.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("keys: unknown key %q", kid)
+	}
+	if k.Type != typ {
+		return nil, fmt.Errorf("keys: key %q is not an %s key", kid, typ)
+	}
+	return k, nil
+}
+
+// signingInput binds the signature to the sending device, to how the payload
+// is to be read and to the named application properties, not just to its bytes.
+func signingInput(deviceID, contentType, contentEncoding string, props map[string]string, names []string, payload []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s\n%s\n%s\n", deviceID, contentType, contentEncoding)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%q=%q\n", name, props[name])
+	}
+	b.WriteByte('\n')
+	b.Write(payload)
+	return b.Bytes()
+}
+
+// isSigProp reports whether the property is one of the signature's own.
+func isSigProp(name string) bool {
+	return name == PropSig || name == PropSigAlg || name == PropSigKid || name == PropSigProps
+}
+
+// Sign signs the payload and all the application properties with the given
+// HMAC or Ed25519 key and returns the signature properties to send along.
+func (kr *Keyring) Sign(kid, deviceID, contentType, contentEncoding string, props map[string]string, payload []byte) (map[string]string, error) {
+	k, ok := kr.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("keys: unknown key %q", kid)
+	}
+	names := make([]string, 0, len(props))
+	for name := range props {
+		if strings.Contains(name, ",") {
+			return nil, fmt.Errorf("keys: property name %q can't be signed", name)
+		}
+		if !isSigProp(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	in := signingInput(deviceID, contentType, contentEncoding, props, names, payload)
+	var alg string
+	var sig []byte
+	switch k.Type {
+	case KeyHMAC:
+		h := hmac.New(sha256.New, k.secret)
+		h.Write(in)
+		alg, sig = AlgHMAC, h.Sum(nil)
+	case KeyEd25519:
+		if k.priv == nil {
+			return nil, fmt.Errorf("keys: key %q has no private key", kid)
+		}
+		alg, sig = AlgEd25519, ed25519.Sign(k.priv, in)
+	default:
+		return nil, fmt.Errorf("keys: key %q can't sign", kid)
+	}
+	return map[string]string{
+		PropSigAlg:   alg,
+		PropSigKid:   kid,
+		PropSig:      base64.StdEncoding.EncodeToString(sig),
+		PropSigProps: strings.Join(names, ","),
+	}, nil
+}
+
+// errUnsigned is returned by Verify for messages without a signature.
+var errUnsigned = errors.New("keys: message is not signed")
+
+// Verify checks the signature given in the message properties, properties
+// added on the way, like message enrichments, are left out unless in mustSign.
+func (kr *Keyring) Verify(props map[string]string, deviceID, contentType, contentEncoding string, payload []byte) error {
+	if props[PropSig] == "" {
+		return errUnsigned
+	}
+	sig, err := base64.StdEncoding.DecodeString(props[PropSig])
+	if err != nil {
+		return err
+	}
+	var names []string
+	if props[PropSigProps] != "" {
+		names = strings.Split(props[PropSigProps], ",")
+	}
+	signed := make(map[string]bool, len(names))
+	for _, name := range names {
+		if _, ok := props[name]; !ok {
+			return fmt.Errorf("keys: signed property %q is missing", name)
+		}
+		signed[name] = true
+	}
+	for _, name := range mustSign {
+		if _, ok := props[name]; ok && !signed[name] {
+			return fmt.Errorf("keys: property %q is not signed", name)
+		}
+	}
+	in := signingInput(deviceID, contentType, contentEncoding, props, names, payload)
+	switch props[PropSigAlg] {
+	case AlgHMAC:
+		k, err := kr.Lookup(props[PropSigKid], KeyHMAC)
+		if err != nil {
+			return err
+		}
+		h := hmac.New(sha256.New, k.secret)
+		h.Write(in)
+		if !hmac.Equal(h.Sum(nil), sig) {
+			return errors.New("keys: hmac signature mismatch")
+		}
+	case AlgEd25519:
+		k, err := kr.Lookup(props[PropSigKid], KeyEd25519)
+		if err != nil {
+			return err
+		}
+		if !ed25519.Verify(k.pub, in, sig) {
+			return errors.New("keys: ed25519 signature mismatch")
+		}
+	default:
+		return fmt.Errorf("keys: unknown signature algorithm %q", props[PropSigAlg])
+	}
+	return nil
+}
+
+// Encrypt encrypts the payload with the given AES key, the random nonce is
+// prepended to the ciphertext, and returns the properties to send along.
+func (kr *Keyring) Encrypt(kid, deviceID string, payload []byte) ([]byte, map[string]string, error) {
+	k, err := kr.Lookup(kid, KeyAES)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newGCM(k.secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return aead.Seal(nonce, nonce, payload, []byte(deviceID)), map[string]string{
+		PropEncAlg: AlgAES256GCM,
+		PropEncKid: kid,
+	}, nil
+}
+
+// Decrypt decrypts a payload encrypted with Encrypt.
+func (kr *Keyring) Decrypt(props map[string]string, deviceID string, payload []byte) ([]byte, error) {
+	if props[PropEncAlg] != AlgAES256GCM {
+		return nil, fmt.Errorf("keys: unknown encryption algorithm %q", props[PropEncAlg])
+	}
+	k, err := kr.Lookup(props[PropEncKid], KeyAES)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(k.secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < aead.NonceSize() {
+		return nil, errors.New("keys: ciphertext too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, payload[:n], payload[n:], []byte(deviceID))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+)
+
+// testKeyring returns a keyring of an hmac, an ed25519 and an aes key,
+// and one holding only the ed25519 public key, as the subscriber would.
+func testKeyring(t *testing.T) (*Keyring, *Keyring) {
+	t.Helper()
+	seed := bytes.Repeat([]byte{7}, ed25519.SeedSize)
+	pub := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	keys := []*Key{
+		{ID: "hmac-1", Type: KeyHMAC, Key: base64.StdEncoding.EncodeToString([]byte("secret"))},
+		{ID: "ed-1", Type: KeyEd25519, Key: base64.StdEncoding.EncodeToString(seed)},
+		{ID: "aes-1", Type: KeyAES, Key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))},
+	}
+	public := []*Key{
+		{ID: "hmac-1", Type: KeyHMAC, Key: keys[0].Key},
+		{ID: "ed-1", Type: KeyEd25519, Public: base64.StdEncoding.EncodeToString(pub)},
+		{ID: "aes-1", Type: KeyAES, Key: keys[2].Key},
+	}
+	kr := func(keys []*Key) *Keyring {
+		r := &Keyring{keys: map[string]*Key{}}
+		for _, k := range keys {
+			if err := k.decode(); err != nil {
+				t.Fatal(err)
+			}
+			r.keys[k.ID] = k
+		}
+		return r
+	}
+	return kr(keys), kr(public)
+}
+
+// signed returns the properties of a message signed with kid.
+func signed(t *testing.T, kr *Keyring, kid string, props map[string]string, payload []byte) map[string]string {
+	t.Helper()
+	all := map[string]string{}
+	for k, v := range props {
+		all[k] = v
+	}
+	sig, err := kr.Sign(kid, "beagle-1", ContentTypeJSON, "utf-8", all, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range sig {
+		all[k] = v
+	}
+	return all
+}
+
+func TestSignVerify(t *testing.T) {
+	signer, verifier := testKeyring(t)
+	payload := []byte(`{"temperature":21.5}`)
+	props := map[string]string{PropSeq: "42", PropBootID: "b00t", "alert": "too-hot", "priority": "high"}
+
+	tests := []struct {
+		name   string
+		change func(p map[string]string) []byte // changes the properties and returns the payload
+		ok     bool
+	}{
+		{"as sent", func(p map[string]string) []byte { return payload }, true},
+		{"enrichment added", func(p map[string]string) []byte { p["site"] = "plant1"; return payload }, true},
+		{"payload altered", func(p map[string]string) []byte { return []byte(`{"temperature":12.5}`) }, false},
+		{"seq replayed", func(p map[string]string) []byte { p[PropSeq] = "43"; return payload }, false},
+		{"boot ID changed", func(p map[string]string) []byte { p[PropBootID] = "other"; return payload }, false},
+		{"rule property altered", func(p map[string]string) []byte { p["priority"] = "low"; return payload }, false},
+		{"signed property dropped", func(p map[string]string) []byte { delete(p, "alert"); return payload }, false},
+		{"batch count added", func(p map[string]string) []byte { p[BatchProperty] = "2"; return payload }, false},
+		{"signed list trimmed", func(p map[string]string) []byte {
+			p[PropSigProps] = "alert,boot-id,priority"
+			delete(p, PropSeq)
+			return payload
+		}, false},
+		{"other key ID", func(p map[string]string) []byte { p[PropSigKid] = "aes-1"; return payload }, false},
+		{"unsigned", func(p map[string]string) []byte { delete(p, PropSig); return payload }, false},
+	}
+	for _, kid := range []string{"hmac-1", "ed-1"} {
+		for _, tt := range tests {
+			t.Run(kid+"/"+tt.name, func(t *testing.T) {
+				p := signed(t, signer, kid, props, payload)
+				b := tt.change(p)
+				err := verifier.Verify(p, "beagle-1", ContentTypeJSON, "utf-8", b)
+				if (err == nil) != tt.ok {
+					t.Fatalf("Verify = %v, want ok %v", err, tt.ok)
+				}
+			})
+		}
+		t.Run(kid+"/other device", func(t *testing.T) {
+			p := signed(t, signer, kid, props, payload)
+			if err := verifier.Verify(p, "beagle-2", ContentTypeJSON, "utf-8", payload); err == nil {
+				t.Fatal("Verify as another device: want an error")
+			}
+		})
+	}
+
+	if _, err := verifier.Sign("ed-1", "beagle-1", ContentTypeJSON, "", nil, payload); err == nil {
+		t.Fatal("Sign with a public key only: want an error")
+	}
+	if _, err := signer.Sign("hmac-1", "beagle-1", ContentTypeJSON, "", map[string]string{"a,b": "1"}, payload); err == nil {
+		t.Fatal("Sign of a property name with a comma: want an error")
+	}
+}
+
+func TestVerifierOpen(t *testing.T) {
+	signer, verifier := testKeyring(t)
+	plain := []byte(`{"temperature":21.5}`)
+	message := func(props map[string]string, payload []byte) *amqp.Message {
+		ap := map[string]interface{}{}
+		for k, v := range props {
+			ap[k] = v
+		}
+		return &amqp.Message{
+			Annotations:           amqp.Annotations{"iothub-connection-device-id": "beagle-1"},
+			Properties:            &amqp.MessageProperties{ContentType: ContentTypeJSON, ContentEncoding: "utf-8"},
+			ApplicationProperties: ap,
+			Data:                  [][]byte{payload},
+		}
+	}
+
+	enc, encProps, err := signer.Encrypt("aes-1", "beagle-1", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encProps[PropSeq] = "1"
+
+	v := &Verifier{Keys: verifier, Policy: VerifyFlag}
+	msg := message(signed(t, signer, "ed-1", encProps, enc), enc)
+	if err := v.open(msg); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.GetData(), plain) || msg.ApplicationProperties[PropSigVerified] != true {
+		t.Fatalf("open = %q verified %v, want decrypted and verified", msg.GetData(), msg.ApplicationProperties[PropSigVerified])
+	}
+
+	// a bad signature still gets the payload decrypted, flagged
+	p := signed(t, signer, "ed-1", encProps, enc)
+	p[PropSeq] = "2"
+	msg = message(p, enc)
+	if err := v.open(msg); err == nil {
+		t.Fatal("open with a replayed seq: want an error")
+	}
+	if !bytes.Equal(msg.GetData(), plain) || msg.ApplicationProperties[PropSigVerified] != false {
+		t.Fatalf("open = %q verified %v, want decrypted and unverified", msg.GetData(), msg.ApplicationProperties[PropSigVerified])
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// HandlerError is an error returned by the event handler, as opposed to
+// transport errors, the supervisor gives up on it instead of reconnecting.
+type HandlerError struct {
+	Err error
+}
+
+func (e *HandlerError) Error() string {
+	return "handler: " + e.Err.Error()
+}
+
+// Unwrap returns the handler's error.
+func (e *HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// Error kinds, telling the supervisor how much to reconnect.
+const (
+	ErrKindHandler      = "handler"         // the handler failed, give up
+	ErrKindLinkDetached = "link-detached"   // reattach the links
+	ErrKindRedirect     = "redirect"        // resolve the endpoint again
+	ErrKindToken        = "token"           // authorization failed or expired
+	ErrKindConnLost     = "connection-lost" // reconnect
+)
+
+func init() {
+	metrics.Help("amqpsub_reconnects_total", "Subscriber reconnects by error kind.")
+}
+
+// classifyError returns the kind of a subscription error.
+func classifyError(err error) string {
+	var herr *HandlerError
+	if errors.As(err, &herr) {
+		return ErrKindHandler
+	}
+	var derr *amqp.DetachError
+	if errors.As(err, &derr) {
+		if derr.RemoteError == nil {
+			return ErrKindLinkDetached
+		}
+		err = derr.RemoteError
+	}
+	var aerr *amqp.Error
+	if errors.As(err, &aerr) {
+		switch aerr.Condition {
+		case amqp.ErrorLinkRedirect, amqp.ErrorConnectionRedirect:
+			return ErrKindRedirect
+		case amqp.ErrorUnauthorizedAccess:
+			return ErrKindToken
+		case amqp.ErrorConnectionForced:
+			return ErrKindConnLost
+		}
+		return ErrKindLinkDetached
+	}
+	var terr *TokenError
+	if errors.As(err, &terr) {
+		return ErrKindToken
+	}
+	if err == amqp.ErrLinkClosed || err == amqp.ErrSessionClosed {
+		return ErrKindLinkDetached
+	}
+	return ErrKindConnLost // amqp.ErrConnClosed, io.EOF, net errors and the rest
+}
+
+// Positions records the offset of the last event delivered per partition,
+// for subscriptions to resume from.
+type Positions struct {
+	mu      sync.Mutex
+	offsets map[string]string
+}
+
+// NewPositions returns empty positions.
+func NewPositions() *Positions {
+	return &Positions{offsets: map[string]string{}}
+}
+
+// WithSubscribePositions records the positions of the events delivered.
+func WithSubscribePositions(p *Positions) SubscribeOption {
+	return func(s *sub) {
+		s.positions = p
+	}
+}
+
+func (p *Positions) delivered(partition string, msg *amqp.Message) {
+	if offset, ok := msg.Annotations["x-opt-offset"].(string); ok {
+		p.mu.Lock()
+		p.offsets[partition] = offset
+		p.mu.Unlock()
+	}
+}
+
+// resume returns options starting every partition after its last delivered event.
+func (p *Positions) resume() []SubscribeOption {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	opts := make([]SubscribeOption, 0, len(p.offsets))
+	for partition, offset := range p.offsets {
+		opts = append(opts, WithSubscribePartitionStart(partition, StartAtOffset(offset, false)))
+	}
+	return opts
+}
+
+// dialHub connects to the AMQP broker of the hub.
+func dialHub(sak *SharedAccessKey, tc *tls.Config) (*amqp.Client, error) {
+	c, err := amqp.Dial("amqps://"+sak.HostName,
+		amqp.ConnTLSConfig(tc),
+		amqp.ConnProperty("com.microsoft:client-version", userAgent),
+	)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("connected to %s\n", sak.HostName)
+	return c, nil
+}
+
+// superviseEvents subscribes to D2C events of the hub of sak and keeps the
+// subscription going through transport errors, reconnecting with backoff and
+// resuming each partition after the last event delivered.
+// It returns handler errors, as *HandlerError, tokens the hub refuses,
+// as *TokenError, and when the context is done.
+func superviseEvents(ctx context.Context, sak *SharedAccessKey, fn EventHandler, tc *tls.Config, opts ...EventsOption) error {
+	const healthy = time.Minute // runs longer than this reset the backoff
+	b := &backoff{min: time.Second, max: 2 * time.Minute}
+	pos := NewPositions()
+	started := time.Now()
+
+	var ep *EventHubEndpoint
+	for {
+		var err error
+		start := time.Now()
+		if ep == nil {
+			// the hub connection is only needed for the redirect
+			var c *amqp.Client
+			if c, err = dialHub(sak, tc); err == nil {
+				ep, err = resolveEventHub(ctx, c, sak)
+				c.Close()
+			}
+		}
+		if ep != nil {
+			runOpts := append(append([]EventsOption{}, opts...),
+				WithEventHubEndpoint(ep),
+				WithSubscribeOptions(append([]SubscribeOption{
+					WithSubscribePositions(pos), withSubscribeLatestSince(started),
+				}, pos.resume()...)...),
+			)
+			err = subscribeEvents(nil, ctx, sak, fn, tc, runOpts...)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		kind := classifyError(err)
+		if kind == ErrKindHandler {
+			return err
+		}
+		// a wrong key or policy won't get any better by reconnecting
+		var terr *TokenError
+		if errors.As(err, &terr) && terr.fatal() {
+			return err
+		}
+		if kind != ErrKindLinkDetached {
+			ep = nil // reconnecting, follow the redirect again
+		}
+		metrics.Inc("amqpsub_reconnects_total", "kind", kind)
+		if time.Since(start) > healthy {
+			b.reset()
+		}
+		log.Printf("subscription %s: %v, reconnecting\n", kind, err)
+		if err := b.wait(ctx); err != nil {
+			return err
+		}
+	}
+}
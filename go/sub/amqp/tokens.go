@@ -0,0 +1,302 @@
+package main
+
+// This file is shared with go/iotservice/tokens.go, keep both copies in sync.
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+// TokenError is the $cbs node refusing a token.
+type TokenError struct {
+	Code int // status-code of the response
+	Err  error
+}
+
+func (e *TokenError) Error() string {
+	return "put token: " + e.Err.Error()
+}
+
+// Unwrap returns the put token error.
+func (e *TokenError) Unwrap() error {
+	return e.Err
+}
+
+// fatal reports whether trying again won't help, the key or audience is wrong.
+func (e *TokenError) fatal() bool {
+	return e.Code == 401 || e.Code == 403 || e.Code == 404
+}
+
+// TokenManager puts tokens on the $cbs node of a connection for one or more
+// audiences and renews them before they expire, until it's closed or the
+// context it's bound to is done.
+type TokenManager struct {
+	conn        *amqp.Client
+	sak         *SharedAccessKey
+	lifetime    time.Duration
+	renewBefore time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wake   chan struct{} // an audience was added
+	errc   chan error
+	done   chan struct{}
+
+	mu     sync.Mutex // serializes $cbs requests
+	sess   *amqp.Session
+	expiry map[string]time.Time // audience -> token expiry
+}
+
+// TokenOption is a TokenManager option.
+type TokenOption func(m *TokenManager)
+
+// WithTokenLifetime sets the lifetime of tokens, 1h by default,
+// and how long before they expire they're renewed, 10m by default.
+func WithTokenLifetime(lifetime, renewBefore time.Duration) TokenOption {
+	return func(m *TokenManager) {
+		m.lifetime, m.renewBefore = lifetime, renewBefore
+	}
+}
+
+// NewTokenManager returns a token manager for the connection, bound to ctx.
+func NewTokenManager(ctx context.Context, conn *amqp.Client, sak *SharedAccessKey, opts ...TokenOption) *TokenManager {
+	m := &TokenManager{
+		conn:        conn,
+		sak:         sak,
+		lifetime:    time.Hour,
+		renewBefore: 10 * time.Minute,
+		wake:        make(chan struct{}, 1),
+		errc:        make(chan error, 1),
+		done:        make(chan struct{}),
+		expiry:      map[string]time.Time{},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	go m.run()
+	return m
+}
+
+// Put puts a token for the audience, e.g. the hub's host name,
+// and keeps renewing it.
+func (m *TokenManager) Put(ctx context.Context, audience string) error {
+	m.mu.Lock()
+	err := m.put(ctx, audience)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Err returns a channel receiving the error the manager gave up on,
+// the hub refusing a token or a token expiring before it could be renewed.
+func (m *TokenManager) Err() <-chan error {
+	return m.errc
+}
+
+// Close stops renewing tokens.
+func (m *TokenManager) Close() error {
+	m.cancel()
+	<-m.done
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sess != nil {
+		err := m.sess.Close(context.Background())
+		m.sess = nil
+		return err
+	}
+	return nil
+}
+
+// put puts the token of the audience, m.mu held.
+func (m *TokenManager) put(ctx context.Context, audience string) error {
+	if m.sess == nil {
+		sess, err := m.conn.NewSession()
+		if err != nil {
+			return err
+		}
+		m.sess = sess
+	}
+	expiry := time.Now().Add(m.lifetime)
+	if err := putToken(ctx, m.sess, m.sak, audience, m.lifetime); err != nil {
+		var terr *TokenError
+		if !errors.As(err, &terr) {
+			// the session may be broken, start over on the next try
+			_ = m.sess.Close(context.Background())
+			m.sess = nil
+		}
+		return err
+	}
+	m.expiry[audience] = expiry
+	return nil
+}
+
+// due returns the audience to renew next and when.
+func (m *TokenManager) due() (string, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var audience string
+	var at time.Time
+	for a, e := range m.expiry {
+		if t := e.Add(-m.renewBefore); audience == "" || t.Before(at) {
+			audience, at = a, t
+		}
+	}
+	return audience, at
+}
+
+func (m *TokenManager) run() {
+	defer close(m.done)
+	b := &backoff{min: time.Second, max: time.Minute}
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		audience, at := m.due()
+		d := time.Until(at)
+		if audience == "" {
+			d = time.Hour
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d)
+		select {
+		case <-timer.C:
+		case <-m.wake:
+			continue
+		case <-m.ctx.Done():
+			return
+		}
+		if audience == "" {
+			continue
+		}
+
+		m.mu.Lock()
+		err := m.put(m.ctx, audience)
+		expiry := m.expiry[audience]
+		m.mu.Unlock()
+		if err == nil {
+			b.reset()
+			log.Printf("token updated for %s\n", audience)
+			continue
+		}
+		if m.ctx.Err() != nil {
+			return
+		}
+		var terr *TokenError
+		if errors.As(err, &terr) && terr.fatal() || !time.Now().Before(expiry) {
+			log.Printf("token for %s not renewed: %v\n", audience, err)
+			m.errc <- err
+			return
+		}
+		log.Printf("put token error for %s, retrying: %v\n", audience, err)
+		if b.wait(m.ctx) != nil {
+			return
+		}
+	}
+}
+
+// putToken puts a token of the key for the audience on the $cbs node,
+// valid for lifetime.
+func putToken(
+	ctx context.Context, sess *amqp.Session, sak *SharedAccessKey, audience string, lifetime time.Duration,
+) error {
+	send, err := sess.NewSender(
+		amqp.LinkTargetAddress("$cbs"),
+	)
+	if err != nil {
+		return err
+	}
+	defer send.Close(context.Background())
+
+	recv, err := sess.NewReceiver(
+		amqp.LinkSourceAddress("$cbs"),
+	)
+	if err != nil {
+		return err
+	}
+	defer recv.Close(context.Background())
+
+	// Seb: https://docs.microsoft.com/en-us/rest/api/eventhub/generate-sas-token
+	//      See the NodeJS version
+	sas, err := sak.Token(audience, lifetime)
+	if err != nil {
+		log.Printf("putToken: %v\n", err)
+		return err
+	}
+	log.Printf("putToken generated for %s, expires %s\n", audience, sas.Se.Format(time.RFC3339))
+
+	if err = send.Send(ctx, &amqp.Message{
+		Value: sas.String(),
+		Properties: &amqp.MessageProperties{
+			To:      "$cbs",
+			ReplyTo: "cbs",
+		},
+		ApplicationProperties: map[string]interface{}{
+			"operation": "put-token",
+			"type":      "servicebus.windows.net:sastoken",
+			"name":      audience,
+		},
+	}); err != nil {
+		log.Printf("putToken send error: %v\n", err)
+		return err
+	}
+
+	msg, err := recv.Receive(ctx)
+	if err != nil {
+		log.Printf("putToken recv error: %v\n", err)
+		return err
+	}
+	if err = msg.Accept(ctx); err != nil {
+		log.Printf("putToken Accept error: %v\n", err)
+		return err
+	}
+	if err = checkMessageResponse(msg); err != nil {
+		rc, _ := msg.ApplicationProperties["status-code"].(int32)
+		return &TokenError{Code: int(rc), Err: err}
+	}
+	return nil
+}
+
+// backoff is an exponential backoff with jitter.
+type backoff struct {
+	min, max time.Duration
+	next     time.Duration
+}
+
+func (b *backoff) wait(ctx context.Context) error {
+	if b.next < b.min {
+		b.next = b.min
+	}
+	d := b.next/2 + time.Duration(rand.Int63n(int64(b.next/2)+1))
+	if b.next *= 2; b.next > b.max {
+		b.next = b.max
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *backoff) reset() {
+	b.next = b.min
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/Azure/go-amqp"
+)
+
+// Verify policies for messages failing signature verification.
+const (
+	// VerifyFlag passes unverified messages to the handler,
+	// flagged with the sig-verified application property set to false.
+	VerifyFlag = "flag"
+
+	// VerifyReject rejects unverified messages without calling the handler.
+	VerifyReject = "reject"
+)
+
+// PropSigVerified is the application property set on every message
+// by the verifier, true only when its signature checked out.
+const PropSigVerified = "sig-verified"
+
+// Verifier checks the device signatures of messages and decrypts
+// their payloads before they reach the event handler.
+type Verifier struct {
+	Keys   *Keyring
+	Policy string
+}
+
+// open verifies the message signature and decrypts the payload in place,
+// it returns an error when the message is unsigned, the signature doesn't
+// check out or the payload can't be decrypted, a payload that decrypts is
+// decrypted either way.
+func (v *Verifier) open(msg *amqp.Message) error {
+	props := make(map[string]string, len(msg.ApplicationProperties))
+	for k, pv := range msg.ApplicationProperties {
+		if s, ok := pv.(string); ok {
+			props[k] = s
+		}
+	}
+	deviceID, _ := msg.Annotations["iothub-connection-device-id"].(string)
+	var ct, ce string
+	if msg.Properties != nil {
+		ct, ce = msg.Properties.ContentType, msg.Properties.ContentEncoding
+	}
+
+	if msg.ApplicationProperties == nil {
+		msg.ApplicationProperties = map[string]interface{}{}
+	}
+	// the signature covers the payload as sent, encrypted payloads are
+	// decrypted whether they're signed or not
+	err := v.Keys.Verify(props, deviceID, ct, ce, msg.GetData())
+	if props[PropEncAlg] != "" {
+		plain, derr := v.Keys.Decrypt(props, deviceID, msg.GetData())
+		if derr != nil && err == nil {
+			err = derr
+		}
+		if derr == nil {
+			msg.Data = [][]byte{plain}
+		}
+	}
+	msg.ApplicationProperties[PropSigVerified] = err == nil
+	return err
+}
+
+// check opens the message and applies the policy, it reports whether
+// the message is to be passed on to the handler.
+func (v *Verifier) check(ctx context.Context, msg *amqp.Message) (bool, error) {
+	err := v.open(msg)
+	if err == nil {
+		return true, nil
+	}
+	deviceID, _ := msg.Annotations["iothub-connection-device-id"].(string)
+	if v.Policy != VerifyReject {
+		log.Printf("unverified message from %q flagged: %v\n", deviceID, err)
+		return true, nil
+	}
+	log.Printf("unverified message from %q rejected: %v\n", deviceID, err)
+	return false, msg.Reject(ctx, &amqp.Error{
+		Condition:   "com.microsoft:unauthorized-access",
+		Description: fmt.Sprintf("signature verification failed: %v", err),
+	})
+}
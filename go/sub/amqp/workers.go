@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"github.com/Azure/go-amqp"
+)
+
+// Orders kept by concurrent handlers.
+const (
+	OrderByPartition = "partition" // events of a partition are handled one at a time, in order
+	OrderByDevice    = "device"    // events of a device are handled one at a time, in order
+)
+
+// WithSubscribeWorkers handles events on n workers, keeping the order of events
+// of a partition or of a device, each worker queueing up to buffer events.
+// A full queue stops the partition links it's fed by from receiving, and so
+// from issuing credit, until the worker catches up.
+// Events are handled by one worker by default.
+func WithSubscribeWorkers(n int, orderBy string, buffer int) SubscribeOption {
+	return func(s *sub) {
+		s.workers, s.orderBy, s.buffer = n, orderBy, buffer
+	}
+}
+
+// WithSubscribePrefetch sets the credit of partition links,
+// the number of events the hub sends ahead of them being received.
+func WithSubscribePrefetch(credit uint32) SubscribeOption {
+	return WithSubscribeLinkOption(amqp.LinkCredit(credit))
+}
+
+// delivery is an event received on a partition.
+type delivery struct {
+	partition string
+	msg       *amqp.Message
+	done      bool
+}
+
+// key returns the key of the delivery the order is kept by.
+func (d *delivery) key(orderBy string) string {
+	if orderBy == OrderByDevice {
+		if id, ok := d.msg.Annotations["iothub-connection-device-id"].(string); ok {
+			return id
+		}
+	}
+	return d.partition
+}
+
+// inflight keeps the deliveries of every partition in the order received,
+// until they're handled. Deliveries handled out of order, on different workers,
+// are committed once all the ones before them on the partition are handled,
+// so checkpoints never skip an event.
+type inflight struct {
+	mu     sync.Mutex
+	parts  map[string][]*delivery
+	commit func(d *delivery) // called in partition order, f.mu held
+}
+
+func (f *inflight) add(d *delivery) {
+	f.mu.Lock()
+	f.parts[d.partition] = append(f.parts[d.partition], d)
+	f.mu.Unlock()
+}
+
+func (f *inflight) done(d *delivery) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d.done = true
+	q := f.parts[d.partition]
+	i := 0
+	for ; i < len(q) && q[i].done; i++ {
+		f.commit(q[i])
+		q[i] = nil
+	}
+	f.parts[d.partition] = q[i:]
+}
+
+// pool is a set of workers, each handling the deliveries of its keys in order.
+type pool struct {
+	orderBy string
+	queues  []chan *delivery
+	wg      sync.WaitGroup
+}
+
+func newPool(n int, orderBy string, buffer int) *pool {
+	if n < 1 {
+		n = 1
+	}
+	p := &pool{orderBy: orderBy, queues: make([]chan *delivery, n)}
+	for i := range p.queues {
+		p.queues[i] = make(chan *delivery, buffer)
+	}
+	return p
+}
+
+// queue returns the queue of the worker handling the delivery's key.
+func (p *pool) queue(d *delivery) chan<- *delivery {
+	h := fnv.New32a()
+	h.Write([]byte(d.key(p.orderBy)))
+	return p.queues[h.Sum32()%uint32(len(p.queues))]
+}
+
+// run starts the workers, calling fn for each delivery until ctx is done,
+// the first error is sent on errc.
+func (p *pool) run(ctx context.Context, fn func(d *delivery) error, errc chan<- error) {
+	for _, q := range p.queues {
+		p.wg.Add(1)
+		go func(q chan *delivery) {
+			defer p.wg.Done()
+			for {
+				select {
+				case d := <-q:
+					if err := fn(d); err != nil {
+						select {
+						case errc <- err:
+						case <-ctx.Done():
+						}
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(q)
+	}
+}
+
+// wait waits for the workers to return, their last events handled.
+func (p *pool) wait() {
+	p.wg.Wait()
+}
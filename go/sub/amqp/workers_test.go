@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+)
+
+func testDelivery(partition, deviceID string, seq int) *delivery {
+	return &delivery{partition: partition, msg: &amqp.Message{
+		Annotations: amqp.Annotations{
+			"iothub-connection-device-id": deviceID,
+			"x-opt-sequence-number":       int64(seq),
+		},
+	}}
+}
+
+func deliveryName(d *delivery) string {
+	return fmt.Sprintf("%s/%d", d.partition, d.msg.Annotations["x-opt-sequence-number"])
+}
+
+func TestInflightCommitsInOrder(t *testing.T) {
+	var commits []string
+	f := &inflight{parts: map[string][]*delivery{}, commit: func(d *delivery) {
+		commits = append(commits, deliveryName(d))
+	}}
+	p0 := []*delivery{testDelivery("0", "a", 1), testDelivery("0", "b", 2), testDelivery("0", "a", 3), testDelivery("0", "c", 4)}
+	p1 := []*delivery{testDelivery("1", "a", 1), testDelivery("1", "b", 2)}
+	for _, d := range append(append([]*delivery{}, p0...), p1...) {
+		f.add(d)
+	}
+
+	steps := []struct {
+		done *delivery
+		want string
+	}{
+		{p0[2], ""},
+		{p1[1], ""},
+		{p0[0], "0/1"},
+		{p0[3], "0/1"},
+		{p1[0], "0/1 1/1 1/2"},
+		{p0[1], "0/1 1/1 1/2 0/2 0/3 0/4"},
+	}
+	for _, s := range steps {
+		f.done(s.done)
+		if got := strings.Join(commits, " "); got != s.want {
+			t.Fatalf("after %s done, commits = %q, want %q", deliveryName(s.done), got, s.want)
+		}
+	}
+	if len(f.parts["0"]) != 0 || len(f.parts["1"]) != 0 {
+		t.Fatalf("inflight left = %d, %d, want none", len(f.parts["0"]), len(f.parts["1"]))
+	}
+}
+
+// TestPoolKeepsOrder has a slow device whose events finish after later ones
+// of other devices on the same partition, checkpoints must still follow
+// the partition order, and each device's events be handled in order.
+func TestPoolKeepsOrder(t *testing.T) {
+	const workers = 4
+	p := newPool(workers, OrderByDevice, 16)
+
+	// devices on different workers
+	devices := []string{"slow"}
+	for i := 0; len(devices) < 3; i++ {
+		id := fmt.Sprintf("fast-%d", i)
+		q := p.queue(testDelivery("0", id, 0))
+		taken := false
+		for _, d := range devices {
+			taken = taken || p.queue(testDelivery("0", d, 0)) == q
+		}
+		if !taken {
+			devices = append(devices, id)
+		}
+	}
+
+	var mu sync.Mutex
+	var commits []string
+	allCommitted := make(chan struct{})
+	const perPartition = 30
+	f := &inflight{parts: map[string][]*delivery{}, commit: func(d *delivery) {
+		commits = append(commits, deliveryName(d))
+		if len(commits) == 2*perPartition {
+			close(allCommitted)
+		}
+	}}
+
+	handled := map[string][]string{}
+	var finished []string
+	busy := map[string]bool{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	p.run(ctx, func(d *delivery) error {
+		id := d.msg.Annotations["iothub-connection-device-id"].(string)
+		mu.Lock()
+		if busy[id] {
+			mu.Unlock()
+			return fmt.Errorf("device %s handled on two workers at once", id)
+		}
+		busy[id] = true
+		mu.Unlock()
+		if id == "slow" {
+			time.Sleep(5 * time.Millisecond)
+		}
+		mu.Lock()
+		busy[id] = false
+		handled[id] = append(handled[id], deliveryName(d))
+		finished = append(finished, deliveryName(d))
+		mu.Unlock()
+		f.done(d)
+		return nil
+	}, errc)
+
+	seq := map[string]int{}
+	for i := 0; i < perPartition; i++ {
+		for _, partition := range []string{"0", "1"} {
+			seq[partition]++
+			d := testDelivery(partition, devices[(i+len(partition))%len(devices)], seq[partition])
+			f.add(d)
+			p.queue(d) <- d
+		}
+	}
+
+	select {
+	case <-allCommitted:
+	case err := <-errc:
+		t.Fatal(err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("deliveries not all committed")
+	}
+	cancel()
+	p.wait()
+
+	if inPartitionOrder(finished, true) {
+		t.Fatalf("handled = %v, want the slow device to finish after later events", finished)
+	}
+	if !inPartitionOrder(commits, true) {
+		t.Fatalf("commits = %v, want each partition in order", commits)
+	}
+	for id, names := range handled {
+		if !inPartitionOrder(names, false) {
+			t.Fatalf("device %s handled %v, out of order", id, names)
+		}
+	}
+}
+
+// inPartitionOrder reports whether the partition/seq names are in order
+// within each partition, without skipping any when all is set.
+func inPartitionOrder(names []string, all bool) bool {
+	last := map[string]int{}
+	for _, name := range names {
+		var partition string
+		var n int
+		fmt.Sscanf(strings.Replace(name, "/", " ", 1), "%s %d", &partition, &n)
+		if n <= last[partition] || all && n != last[partition]+1 {
+			return false
+		}
+		last[partition] = n
+	}
+	return true
+}
+
+func TestPoolQueueByKey(t *testing.T) {
+	byDevice := newPool(8, OrderByDevice, 1)
+	byPartition := newPool(8, OrderByPartition, 1)
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("beagle-%d", i)
+		if byDevice.queue(testDelivery("0", id, 1)) != byDevice.queue(testDelivery("3", id, 2)) {
+			t.Fatalf("device %s queued to two workers", id)
+		}
+		if byPartition.queue(testDelivery("2", id, 1)) != byPartition.queue(testDelivery("2", "other", 2)) {
+			t.Fatal("partition 2 queued to two workers")
+		}
+	}
+	// events without a device are kept in partition order
+	d := &delivery{partition: "5", msg: &amqp.Message{}}
+	if d.key(OrderByDevice) != "5" {
+		t.Fatalf("key of an event without a device = %q, want its partition", d.key(OrderByDevice))
+	}
+}